@@ -0,0 +1,423 @@
+// Package manifest reads and writes the netskeldb manifest, the list of
+// every file and directory a netskel server distributes to its clients.
+//
+// A manifest travels in one of two formats.  The legacy tab-separated format
+// is what the Bourne shell client has always understood, and the JSON format
+// is a versioned document which survives filenames containing whitespace.
+// Parse accepts either one.
+package manifest
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// VERSION is the revision of the manifest document format.
+const VERSION = 1
+
+// Entry types.
+const (
+	TypeFile    = "file"
+	TypeDir     = "dir"
+	TypeSymlink = "symlink"
+
+	// TypeTombstone marks a path which the server used to send but which is
+	// no longer part of the db.  For a file its Hash is the content the
+	// client was last given, and a client should remove its copy only when
+	// the local file still has that fingerprint; anything else is a local
+	// modification to be left alone.  A removed symlink keeps its Target
+	// instead, and a removed directory has neither.  Tombstones are repeated
+	// for a while so clients which skip a sync still see them.
+	TypeTombstone = "tombstone"
+)
+
+// MetaRun is the Meta key holding a shell command a client runs once it has
+// installed a new version of a file entry, and never when the file was
+// already up to date.
+const MetaRun = "run"
+
+// DIRECTIVE prefixes the machine readable header lines of a TSV manifest.
+// Legacy clients discard any line containing a '#' so these are invisible
+// to them.
+const DIRECTIVE = "#@ "
+
+// Entry describes a single path served to clients.
+type Entry struct {
+	Path   string            `json:"path"`
+	Type   string            `json:"type"`
+	Mode   uint32            `json:"mode"`
+	Size   int64             `json:"size,omitempty"`
+	Hash   string            `json:"hash,omitempty"`
+	MTime  int64             `json:"mtime,omitempty"`
+	Target string            `json:"target,omitempty"`
+	Meta   map[string]string `json:"meta,omitempty"`
+}
+
+// Manifest is a complete netskeldb document.  NextSync is the number of
+// seconds the server would like a client to wait before its next sync, or 0
+// when the server has no opinion.
+type Manifest struct {
+	Version     int       `json:"version"`
+	Revision    string    `json:"revision,omitempty"`
+	NotModified bool      `json:"notModified,omitempty"`
+	NextSync    int64     `json:"nextSync,omitempty"`
+	Commit      string    `json:"commit,omitempty"`
+	Client      string    `json:"client,omitempty"`
+	Address     string    `json:"address,omitempty"`
+	Generator   string    `json:"generator,omitempty"`
+	Generated   time.Time `json:"generated"`
+	Entries     []Entry   `json:"entries"`
+}
+
+// New returns an empty manifest of the current version.
+func New() *Manifest {
+	return &Manifest{
+		Version:   VERSION,
+		Generated: time.Now(),
+		Entries:   []Entry{},
+	}
+}
+
+// ParseInterval reads a sync interval, such as the server sends as NextSync,
+// given as a number of seconds or a duration such as "90m", returning it in
+// seconds.
+func ParseInterval(value string) (int64, error) {
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil && secs > 0 {
+		return secs, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d < time.Second {
+		return 0, fmt.Errorf("%q is not a sync interval", value)
+	}
+
+	return int64(d / time.Second), nil
+}
+
+// Line formats e as a line of the TSV manifest, without the newline.  The
+// mtime column is left off when unknown and there's nothing after it, so
+// the line reads exactly as the original server wrote it.
+func (e Entry) Line() string {
+	fields := []string{e.Path, strconv.FormatUint(uint64(e.Mode), 8), "*", strconv.FormatInt(e.Size, 10), e.Hash}
+
+	switch e.Type {
+	case TypeDir:
+		fields[0] += "/"
+		fields[3] = ""
+	case TypeTombstone:
+		fields[2] = "-"
+	case TypeSymlink:
+		fields[2] = "@"
+	}
+
+	action := e.Meta[MetaRun]
+	// A removed symlink keeps its target, so clients only remove a link
+	// which still points where the server put it
+	target := e.Type == TypeSymlink || (e.Type == TypeTombstone && e.Target != "")
+
+	switch {
+	case e.MTime != 0 || target || action != "":
+		fields = append(fields, strconv.FormatInt(e.MTime, 10))
+	case e.Type == TypeDir:
+		fields = fields[:3]
+	}
+	if target || action != "" {
+		fields = append(fields, e.Target)
+	}
+	if action != "" {
+		fields = append(fields, action)
+	}
+
+	return strings.Join(fields, "\t")
+}
+
+// Merkle computes the root of a Merkle tree over the entries of m.  It
+// identifies the content of a manifest independently of when or for whom it
+// was generated, so a client can ask whether anything changed since the
+// revision it already holds.
+func (m *Manifest) Merkle() string {
+	level := make([][]byte, len(m.Entries))
+	for i, e := range m.Entries {
+		leaf, _ := json.Marshal(e)
+		level[i] = merkleHash(0x00, leaf)
+	}
+
+	if len(level) == 0 {
+		return hex.EncodeToString(merkleHash(0x00, nil))
+	}
+
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			next = append(next, merkleHash(0x01, level[i], level[i+1]))
+		}
+		level = next
+	}
+
+	return hex.EncodeToString(level[0])
+}
+
+// merkleHash hashes data with a prefix byte which keeps leaf and interior
+// nodes from ever colliding.
+func merkleHash(prefix byte, data ...[]byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{prefix})
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// Contained reports whether a symlink at name pointing to target resolves
+// to somewhere inside the tree holding it.  Links which escape the tree are
+// never served, and clients should refuse them too.
+func Contained(name, target string) bool {
+	if target == "" || path.IsAbs(target) {
+		return false
+	}
+
+	resolved := path.Join(path.Dir(name), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// Without returns a copy of m leaving out entries of the given types, for
+// clients too old to understand them.
+func (m *Manifest) Without(types ...string) *Manifest {
+	c := *m
+	c.Entries = nil
+
+	for _, e := range m.Entries {
+		keep := true
+		for _, t := range types {
+			if e.Type == t {
+				keep = false
+			}
+		}
+		if keep {
+			c.Entries = append(c.Entries, e)
+		}
+	}
+
+	return &c
+}
+
+// WriteTSV writes m in the legacy tab-separated format.
+func (m *Manifest) WriteTSV(w io.Writer) error {
+	now := m.Generated.UTC().Format("Mon, 2 Jan 2006 15:04:05 UTC")
+
+	b := bufio.NewWriter(w)
+	fmt.Fprintf(b, "#\n# .netskeldb for %s at %v\n#\n# Generated %v by %v\n#\n", m.Client, m.Address, now, m.Generator)
+
+	fmt.Fprintf(b, "%sversion %d\n", DIRECTIVE, m.Version)
+	fmt.Fprintf(b, "%sgenerated %d\n", DIRECTIVE, m.Generated.Unix())
+	if m.Revision != "" {
+		fmt.Fprintf(b, "%srevision %s\n", DIRECTIVE, m.Revision)
+	}
+	if m.NotModified {
+		fmt.Fprintf(b, "%sstatus not-modified\n", DIRECTIVE)
+	}
+	if m.Commit != "" {
+		fmt.Fprintf(b, "%scommit %s\n", DIRECTIVE, m.Commit)
+	}
+	if m.NextSync > 0 {
+		fmt.Fprintf(b, "%snext-sync %d\n", DIRECTIVE, m.NextSync)
+	}
+
+	for _, e := range m.Entries {
+		fmt.Fprintln(b, e.Line())
+	}
+
+	return b.Flush()
+}
+
+// WriteJSON writes m as a JSON document.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
+
+// Parse reads a manifest in either format, deciding which by the first
+// non-blank character of the input.
+func Parse(r io.Reader) (*Manifest, error) {
+	b := bufio.NewReader(r)
+
+	for {
+		c, err := b.ReadByte()
+		if err == io.EOF {
+			return New(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			continue
+		}
+
+		b.UnreadByte()
+		if c == '{' {
+			return ParseJSON(b)
+		}
+		return ParseTSV(b)
+	}
+}
+
+// ParseJSON reads a JSON manifest.
+func ParseJSON(r io.Reader) (*Manifest, error) {
+	m := &Manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+
+	if m.Version > VERSION {
+		return nil, fmt.Errorf("Unsupported manifest version %d", m.Version)
+	}
+
+	return m, nil
+}
+
+// ParseTSV reads a legacy tab-separated manifest.
+func ParseTSV(r io.Reader) (*Manifest, error) {
+	m := New()
+	m.Generated = time.Time{}
+
+	scanner := bufio.NewScanner(r)
+	lineno := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		lineno++
+
+		switch {
+		case strings.HasPrefix(line, DIRECTIVE):
+			if err := m.parseDirective(strings.TrimPrefix(line, DIRECTIVE)); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+			continue
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		}
+
+		e, err := parseLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+		m.Entries = append(m.Entries, e)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *Manifest) parseDirective(directive string) error {
+	fields := strings.SplitN(directive, " ", 2)
+	if len(fields) != 2 {
+		return fmt.Errorf("Malformed directive %q", directive)
+	}
+	key, value := fields[0], fields[1]
+
+	switch key {
+	case "version":
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		if v > VERSION {
+			return fmt.Errorf("Unsupported manifest version %d", v)
+		}
+		m.Version = v
+	case "generated":
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		m.Generated = time.Unix(secs, 0)
+	case "revision":
+		m.Revision = value
+	case "status":
+		m.NotModified = value == "not-modified"
+	case "commit":
+		m.Commit = value
+	case "next-sync":
+		secs, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		m.NextSync = secs
+	}
+
+	// Unknown directives are from a newer server and are safe to ignore.
+	return nil
+}
+
+func parseLine(line string) (Entry, error) {
+	e := Entry{}
+	fields := strings.Split(line, "\t")
+
+	if len(fields) < 3 {
+		return e, fmt.Errorf("Too few fields in %q", line)
+	}
+
+	mode, err := strconv.ParseUint(fields[1], 8, 32)
+	if err != nil {
+		return e, fmt.Errorf("Bad mode %q: %v", fields[1], err)
+	}
+	e.Mode = uint32(mode)
+
+	if len(fields) > 5 {
+		e.MTime, err = strconv.ParseInt(fields[5], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("Bad mtime %q: %v", fields[5], err)
+		}
+	}
+
+	if strings.HasSuffix(fields[0], "/") {
+		e.Type = TypeDir
+		e.Path = strings.TrimSuffix(fields[0], "/")
+		return e, nil
+	}
+
+	if len(fields) < 5 {
+		return e, fmt.Errorf("Too few fields in %q", line)
+	}
+
+	e.Type = TypeFile
+	switch fields[2] {
+	case "-":
+		e.Type = TypeTombstone
+		if len(fields) > 6 {
+			e.Target = fields[6]
+		}
+	case "@":
+		if len(fields) < 7 {
+			return e, fmt.Errorf("Symlink without target in %q", line)
+		}
+		e.Type = TypeSymlink
+		e.Target = fields[6]
+	}
+	if len(fields) > 7 && fields[7] != "" {
+		e.Meta = map[string]string{MetaRun: fields[7]}
+	}
+	e.Path = fields[0]
+	e.Hash = fields[4]
+	e.Size, err = strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("Bad size %q: %v", fields[3], err)
+	}
+
+	return e, nil
+}
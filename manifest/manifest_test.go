@@ -0,0 +1,222 @@
+package manifest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyDB is a netskeldb as generated by servers predating this package.
+const legacyDB = `#
+# .netskeldb for 6ec558e1-5f06-4083-9070-206819b53916 at 192.0.2.1
+#
+# Generated Mon, 2 Jan 2006 15:04:05 UTC by netskel.example.com
+#
+bin/	700	*
+bin/netskel	700	*	9876	0123456789abcdef0123456789abcdef
+.bashrc	600	*	1234	fedcba9876543210fedcba9876543210
+`
+
+func sample() *Manifest {
+	m := New()
+	m.Client = "6ec558e1-5f06-4083-9070-206819b53916"
+	m.Address = "192.0.2.1"
+	m.Generator = "netskel.example.com"
+	m.Generated = time.Unix(1136214245, 0)
+	m.Entries = []Entry{
+		{Path: "bin", Type: TypeDir, Mode: 0700},
+		{Path: "bin/netskel", Type: TypeFile, Mode: 0700, Size: 9876, Hash: "0123456789abcdef0123456789abcdef"},
+		{Path: ".bashrc", Type: TypeFile, Mode: 0600, Size: 1234, Hash: "fedcba9876543210fedcba9876543210"},
+	}
+
+	return m
+}
+
+func TestParseLegacy(t *testing.T) {
+	m, err := Parse(strings.NewReader(legacyDB))
+	assert.Nil(t, err)
+	assert.Equal(t, sample().Entries, m.Entries)
+}
+
+func TestTSVRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), "bin/\t700\t*\n")
+	assert.Contains(t, buf.String(), ".bashrc\t600\t*\t1234\tfedcba9876543210fedcba9876543210\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+	assert.Equal(t, in.Generated.Unix(), out.Generated.Unix())
+}
+
+func TestTombstoneTSV(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+	in.Entries = append(in.Entries, Entry{Path: ".oldrc", Type: TypeTombstone, Mode: 0600, Size: 12, Hash: "00112233445566778899aabbccddeeff"})
+	in.Entries = append(in.Entries, Entry{Path: ".oldlink", Type: TypeTombstone, Mode: 0777, Size: 5, MTime: 1136214245, Target: ".vim"})
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), ".oldrc\t600\t-\t12\t00112233445566778899aabbccddeeff\n")
+	assert.Contains(t, buf.String(), ".oldlink\t777\t-\t5\t\t1136214245\t.vim\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+
+	legacy := in.Without(TypeTombstone)
+	assert.Len(t, legacy.Entries, 3)
+	assert.Len(t, in.Entries, 5, "Without modified the original manifest")
+}
+
+func TestMTimeTSV(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+	in.Entries[0].MTime = 1136214245
+	in.Entries[2].MTime = 1136214246
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), "bin/\t700\t*\t\t\t1136214245\n")
+	assert.Contains(t, buf.String(), ".bashrc\t600\t*\t1234\tfedcba9876543210fedcba9876543210\t1136214246\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+}
+
+func TestActionTSV(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+	in.Entries[2].Meta = map[string]string{MetaRun: "tmux source-file ~/.tmux.conf"}
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), ".bashrc\t600\t*\t1234\tfedcba9876543210fedcba9876543210\t0\t\ttmux source-file ~/.tmux.conf\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+	in.Entries[2].MTime = 1136214245
+	in.Entries[2].Meta = map[string]string{"owner": "luser"}
+
+	assert.Nil(t, in.WriteJSON(&buf))
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+	assert.Equal(t, in.Client, out.Client)
+	assert.Equal(t, VERSION, out.Version)
+}
+
+func TestParseFutureVersion(t *testing.T) {
+	_, err := Parse(strings.NewReader(`{"version": 999, "entries": []}`))
+	assert.NotNil(t, err, "Parsed a manifest from the future")
+
+	_, err = Parse(strings.NewReader("#@ version 999\n"))
+	assert.NotNil(t, err, "Parsed a manifest from the future")
+}
+
+func TestParseMalformed(t *testing.T) {
+	_, err := Parse(strings.NewReader("bin/netskel\t700\t*\n"))
+	assert.NotNil(t, err)
+
+	_, err = Parse(strings.NewReader("bin/\tnope\t*\n"))
+	assert.NotNil(t, err)
+}
+
+func TestParseEmpty(t *testing.T) {
+	m, err := Parse(strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Empty(t, m.Entries)
+}
+
+func TestMerkle(t *testing.T) {
+	a := sample()
+	b := sample()
+	b.Generated = time.Now()
+	b.Client = "someone else"
+
+	assert.Len(t, a.Merkle(), 64)
+	assert.Equal(t, a.Merkle(), b.Merkle(), "Revision depends on more than entries")
+
+	b.Entries[2].Hash = "00000000000000000000000000000000"
+	assert.NotEqual(t, a.Merkle(), b.Merkle(), "Revision ignored a content change")
+
+	b.Entries = b.Entries[:2]
+	assert.NotEqual(t, a.Merkle(), b.Merkle(), "Revision ignored a removed entry")
+
+	assert.NotEqual(t, a.Merkle(), New().Merkle())
+}
+
+func TestNotModifiedRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	in := New()
+	in.Revision = sample().Merkle()
+	in.NotModified = true
+	in.Commit = "0123456789abcdef0123456789abcdef01234567"
+	in.NextSync = 3600
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), "#@ status not-modified\n")
+	assert.Contains(t, buf.String(), "#@ next-sync 3600\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.True(t, out.NotModified)
+	assert.Equal(t, in.Revision, out.Revision)
+	assert.Equal(t, in.Commit, out.Commit)
+	assert.Equal(t, in.NextSync, out.NextSync)
+}
+
+func TestSymlinkTSV(t *testing.T) {
+	var buf bytes.Buffer
+	in := sample()
+	in.Entries = append(in.Entries, Entry{Path: ".vimrc", Type: TypeSymlink, Mode: 0777, Size: 22, MTime: 1136214245, Target: ".config/nvim/init.vim"})
+
+	assert.Nil(t, in.WriteTSV(&buf))
+	assert.Contains(t, buf.String(), ".vimrc\t777\t@\t22\t\t1136214245\t.config/nvim/init.vim\n")
+
+	out, err := Parse(&buf)
+	assert.Nil(t, err)
+	assert.Equal(t, in.Entries, out.Entries)
+}
+
+func TestContained(t *testing.T) {
+	assert.True(t, Contained(".vimrc", ".config/nvim/init.vim"))
+	assert.True(t, Contained("bin/vi", "../opt/nvim/bin/nvim"))
+	assert.True(t, Contained("a/b/c", "../../d"))
+
+	assert.False(t, Contained(".vimrc", "/etc/vimrc"))
+	assert.False(t, Contained(".vimrc", "../.vimrc"))
+	assert.False(t, Contained("bin/vi", "../../usr/bin/vi"))
+	assert.False(t, Contained("bin/vi", ""))
+}
+
+func TestParseInterval(t *testing.T) {
+	for _, tt := range []struct {
+		in  string
+		out int64
+	}{
+		{"3600", 3600},
+		{"90m", 5400},
+		{"1h30m", 5400},
+	} {
+		secs, err := ParseInterval(tt.in)
+		assert.Nil(t, err)
+		assert.Equal(t, tt.out, secs, tt.in)
+	}
+
+	for _, in := range []string{"", "-5", "0", "500ms", "soon"} {
+		_, err := ParseInterval(in)
+		assert.NotNil(t, err, in)
+	}
+}
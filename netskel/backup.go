@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A backup holds whatever one sync replaced or removed, so rollback can put
+// it back.  Its index lists each path in the order sync touched it: U for a
+// path saved under files/, C for one which didn't exist before.
+type backup struct {
+	dir string
+
+	// index maps each path in the index to how it is held, once read.
+	index map[string]string
+}
+
+// syncID names the backup generation of a sync started at t.  A sync
+// started within the same second as an earlier one which backed anything
+// up gets a counter, so each sync has a generation of its own.
+func syncID(dir string, t time.Time) string {
+	id := t.Format("20060102-150405")
+	for n := 2; ; n++ {
+		if _, err := os.Lstat(filepath.Join(dir, id)); os.IsNotExist(err) {
+			return id
+		}
+		id = fmt.Sprintf("%s-%02d", t.Format("20060102-150405"), n)
+	}
+}
+
+// backupIDs lists the backup generations in dir, oldest first.
+func backupIDs(dir string) []string {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	var ids []string
+	for _, info := range infos {
+		if info.IsDir() {
+			ids = append(ids, info.Name())
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// lookup returns how the backup holds name: U for a saved copy, C for a
+// path which didn't exist, or nothing when name isn't in the backup.
+func (b *backup) lookup(name string) string {
+	if b.index == nil {
+		b.loadIndex()
+	}
+
+	return b.index[name]
+}
+
+// loadIndex reads the index, keeping the first entry for each path.
+func (b *backup) loadIndex() {
+	b.index = make(map[string]string)
+
+	f, err := os.Open(filepath.Join(b.dir, "index"))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) == 2 && b.index[fields[1]] == "" {
+			b.index[fields[1]] = fields[0]
+		}
+	}
+}
+
+// save records the path at fullpath, known to the server as name, before
+// it is replaced or removed.  Only the first save of a path counts, so the
+// backup holds what was there before the sync started.
+func (b *backup) save(name, fullpath string) error {
+	if b.lookup(name) != "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Join(b.dir, "files"), 0700); err != nil {
+		return err
+	}
+
+	op := "C"
+	if info, err := os.Lstat(fullpath); err == nil && !info.IsDir() {
+		Debug("Backing up %s to %s", name, b.dir)
+		if err := copyEntry(fullpath, filepath.Join(b.dir, "files", filepath.FromSlash(name))); err != nil {
+			return err
+		}
+		op = "U"
+	}
+
+	return b.record(op, name)
+}
+
+// record adds name to the backup's index.
+func (b *backup) record(op, name string) error {
+	if err := os.MkdirAll(b.dir, 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(b.dir, "index"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = fmt.Fprintf(f, "%s\t%s\n", op, name); err != nil {
+		return err
+	}
+
+	if b.index == nil {
+		b.loadIndex()
+	} else if b.index[name] == "" {
+		b.index[name] = op
+	}
+	return nil
+}
+
+// copyEntry copies the file or symlink at src to dst, keeping its mode and
+// modification time.
+func copyEntry(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	os.Remove(dst)
+
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, dst)
+	}
+
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dst, data, info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+// pruneBackups keeps only the newest keep backup generations in dir.
+func pruneBackups(dir string, keep int) {
+	ids := backupIDs(dir)
+	if keep < 0 || len(ids) <= keep {
+		return
+	}
+
+	for _, id := range ids[:len(ids)-keep] {
+		Debug("Pruning backup %s", id)
+		os.RemoveAll(filepath.Join(dir, id))
+	}
+}
+
+// rollback undoes the sync which made backup generation id, or the latest
+// one when id is empty.  The generation is used up, so each rollback steps
+// one sync further back.
+func rollback(c config, id string) error {
+	dir := c["NETSKEL_BACKUPS"]
+	ids := backupIDs(dir)
+
+	if id == "" && len(ids) > 0 {
+		id = ids[len(ids)-1]
+	}
+	b := backup{dir: filepath.Join(dir, id)}
+
+	f, err := os.Open(filepath.Join(b.dir, "index"))
+	if id == "" || err != nil {
+		return fmt.Errorf("No backup to roll back to.  Available syncs: %s", strings.Join(ids, " "))
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	Log("Rolling back sync %s", id)
+
+	s := &syncer{root: c["NETSKEL_ROOT"]}
+	failed := 0
+
+	// What rollback puts back counts as installed, so the next sync doesn't
+	// take it for a local change
+	installed := loadInstalled(c["NETSKEL_INSTALLED"], loadDB(c["NETSKEL_DBFILE"]))
+	defer func() {
+		if err := saveInstalled(c["NETSKEL_INSTALLED"], installed); err != nil {
+			Log("Unable to save %s: %v", c["NETSKEL_INSTALLED"], err)
+		}
+	}()
+
+	// Newest changes first, so a path touched twice ends up as it started
+	for i := len(lines) - 1; i >= 0; i-- {
+		fields := strings.SplitN(lines[i], "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		op, name := fields[0], fields[1]
+
+		if err := b.restore(s, op, name); err != nil {
+			Log("E %s %v", name, err)
+			failed++
+			continue
+		}
+
+		fullpath, _ := s.localPath(name)
+		if hash, err := fileHash(fullpath); op == "U" && err == nil {
+			installed[name] = hash
+		} else {
+			delete(installed, name)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be rolled back, keeping backup %s", failed, id)
+	}
+
+	return os.RemoveAll(b.dir)
+}
+
+// restore puts one path back as it was before the sync.
+func (b *backup) restore(s *syncer, op, name string) error {
+	fullpath, err := s.localPath(name)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(fullpath); err == nil && info.IsDir() {
+		return fmt.Errorf("is a directory, not rolling it back")
+	}
+
+	if op == "U" {
+		if err := copyEntry(filepath.Join(b.dir, "files", filepath.FromSlash(name)), fullpath); err != nil {
+			return err
+		}
+		Log("U %s", name)
+		return nil
+	}
+
+	if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	Log("R %s", name)
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRollback(t *testing.T) {
+	s, _ := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	os.MkdirAll(filepath.Join(s.root, "Application Support"), 0700)
+	ioutil.WriteFile(filepath.Join(s.root, "Application Support/init.vim"), []byte("mine\n"), 0600)
+	ioutil.WriteFile(filepath.Join(s.root, ".oldrc"), []byte("old\n"), 0600)
+	s.sync()
+
+	ids := backupIDs(s.cfg["NETSKEL_BACKUPS"])
+	assert.Len(t, ids, 1)
+
+	assert.Nil(t, rollback(s.cfg, ""))
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.Nil(t, err)
+	assert.Equal(t, "mine\n", string(data), "Overwritten file was not restored")
+
+	info, _ := os.Stat(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	data, err = ioutil.ReadFile(filepath.Join(s.root, ".oldrc"))
+	assert.Nil(t, err, "Removed file was not restored")
+	assert.Equal(t, "old\n", string(data))
+
+	_, err = os.Lstat(filepath.Join(s.root, ".vimrc"))
+	assert.True(t, os.IsNotExist(err), "Symlink created by the sync was kept")
+
+	// The restored file isn't taken for a local change
+	installed := loadInstalled(s.cfg["NETSKEL_INSTALLED"], nil)
+	assert.Equal(t, fmt.Sprintf("%x", md5.Sum([]byte("mine\n"))), installed["Application Support/init.vim"])
+
+	assert.Empty(t, backupIDs(s.cfg["NETSKEL_BACKUPS"]), "Rolled back generation was kept")
+	assert.NotNil(t, rollback(s.cfg, ""), "Rolled back with no backups left")
+}
+
+func TestBackupKeepsFirstSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, ".profile")
+	b := &backup{dir: filepath.Join(dir, "backup")}
+
+	ioutil.WriteFile(filename, []byte("first\n"), 0600)
+	assert.Nil(t, b.save(".profile", filename))
+	ioutil.WriteFile(filename, []byte("second\n"), 0600)
+	assert.Nil(t, b.save(".profile", filename))
+
+	data, _ := ioutil.ReadFile(filepath.Join(b.dir, "files/.profile"))
+	assert.Equal(t, "first\n", string(data), "A second save replaced the first")
+
+	index, _ := ioutil.ReadFile(filepath.Join(b.dir, "index"))
+	assert.Equal(t, "U\t.profile\n", string(index))
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, id := range []string{"20260101-000000", "20260102-000000", "20260103-000000"} {
+		os.Mkdir(filepath.Join(dir, id), 0700)
+	}
+
+	pruneBackups(dir, 2)
+	assert.Equal(t, []string{"20260102-000000", "20260103-000000"}, backupIDs(dir))
+}
+
+func TestSyncID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.Local)
+	assert.Equal(t, "20260102-030405", syncID(dir, now))
+
+	// Syncs within the same second which backed things up get their own
+	for _, want := range []string{"20260102-030405", "20260102-030405-02", "20260102-030405-03"} {
+		id := syncID(dir, now)
+		assert.Equal(t, want, id)
+		os.Mkdir(filepath.Join(dir, id), 0700)
+	}
+
+	os.Mkdir(filepath.Join(dir, syncID(dir, now.Add(time.Second))), 0700)
+	assert.Equal(t, []string{"20260102-030405", "20260102-030405-02", "20260102-030405-03", "20260102-030406"}, backupIDs(dir), "Generations don't sort in the order they were made")
+}
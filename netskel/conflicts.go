@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// NEWSUFFIX is added to the name of a server update saved alongside a file
+// which was changed locally.
+const NEWSUFFIX = ".netskel-new"
+
+// The NETSKEL_CONFLICT_POLICY settings, for files changed both locally and
+// on the server.
+const (
+	PolicyOverwrite = "overwrite"
+	PolicyKeep      = "keep"
+	PolicyNew       = "new"
+	PolicyFail      = "fail"
+)
+
+// checkPolicy rejects a NETSKEL_CONFLICT_POLICY setting sync doesn't know,
+// before anything is touched.
+func checkPolicy(policy string) error {
+	switch policy {
+	case PolicyOverwrite, PolicyKeep, PolicyNew, PolicyFail:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown NETSKEL_CONFLICT_POLICY %q, expected %s, %s, %s or %s", policy, PolicyNew, PolicyKeep, PolicyOverwrite, PolicyFail)
+}
+
+// loadInstalled reads the hash sync last installed at each path.  Before
+// that record exists the previous manifest stands in for it.
+func loadInstalled(filename string, previous *manifest.Manifest) map[string]string {
+	installed := make(map[string]string)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		if previous != nil {
+			for _, e := range previous.Entries {
+				if e.Type == manifest.TypeFile {
+					installed[e.Path] = e.Hash
+				}
+			}
+		}
+		return installed
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) == 2 {
+			installed[fields[1]] = fields[0]
+		}
+	}
+
+	return installed
+}
+
+// saveInstalled keeps the installed hashes for the next sync.
+func saveInstalled(filename string, installed map[string]string) error {
+	var names []string
+	for name := range installed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s\t%s\n", installed[name], name)
+	}
+
+	return ioutil.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// resolve applies the conflict policy to a file which was changed locally
+// and on the server.  It reports whether sync should go on to overwrite the
+// local changes.
+func (s *syncer) resolve(fullpath, snapshot string, e manifest.Entry) (bool, error) {
+	policy := s.cfg["NETSKEL_CONFLICT_POLICY"]
+	if policy != PolicyOverwrite {
+		s.conflicts = append(s.conflicts, e.Path)
+	}
+
+	switch policy {
+	case PolicyOverwrite:
+		if s.dryRun {
+			s.report("overwrite local changes to %s", e.Path)
+		} else {
+			Log("M %s has local changes, overwriting them", e.Path)
+		}
+		return true, nil
+
+	case PolicyKeep:
+		if s.dryRun {
+			s.report("keep local changes to %s", e.Path)
+		} else {
+			Log("M %s has local changes, keeping them", e.Path)
+		}
+		return false, nil
+
+	case PolicyFail:
+		if s.dryRun {
+			s.report("fail on local changes to %s", e.Path)
+			return false, nil
+		}
+		return false, fmt.Errorf("has local changes, not updated")
+	}
+
+	if s.dryRun {
+		s.report("save %s%s, keeping local changes to %s", e.Path, NEWSUFFIX, e.Path)
+		return false, s.showDiff(fullpath, snapshot, e)
+	}
+
+	if hash, err := fileHash(fullpath + NEWSUFFIX); err == nil && hash == e.Hash {
+		Debug("%s has local changes, update already saved as %s%s", e.Path, e.Path, NEWSUFFIX)
+		return false, nil
+	}
+
+	data, err := s.fetch(snapshot, e)
+	if err != nil {
+		return false, err
+	}
+	if err := s.install(fullpath+NEWSUFFIX, data, e); err != nil {
+		return false, fmt.Errorf("not saved: %v", err)
+	}
+	Log("M %s has local changes, saved the update as %s%s", e.Path, e.Path, NEWSUFFIX)
+
+	return false, nil
+}
+
+// reportConflicts tells the server which files are being held back, when
+// that has changed since the last report or there are any.
+func (s *syncer) reportConflicts() {
+	filename := s.cfg["NETSKEL_CONFLICTS"]
+
+	previous, _ := ioutil.ReadFile(filename)
+	if len(previous) == 0 && len(s.conflicts) == 0 {
+		return
+	}
+
+	if !s.caps.has("commands", "conflicts") {
+		Debug("Server doesn't take conflict reports")
+		return
+	}
+
+	var out bytes.Buffer
+	options := url.Values{"path": s.conflicts}
+	cmd, err := s.caps.command("conflicts", options, s.uuid, whoami(), hostname())
+	if err != nil {
+		Debug("Unable to report conflicts: %v", err)
+		return
+	}
+	if err := s.remote.Run(cmd, &out); err != nil {
+		Debug("Unable to report conflicts: %v", serverError(out.Bytes(), err))
+		return
+	}
+
+	if len(s.conflicts) == 0 {
+		os.Remove(filename)
+		return
+	}
+	ioutil.WriteFile(filename, []byte(strings.Join(s.conflicts, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// conflictSyncer returns a syncer which has synced once, after which both
+// the server and the local copy of init.vim changed.
+func conflictSyncer(t *testing.T, policy string) (*syncer, *fakeRemote, string) {
+	s, r := testSyncer(t)
+	s.cfg["NETSKEL_CONFLICT_POLICY"] = policy
+	s.sync()
+
+	filename := filepath.Join(s.root, "Application Support/init.vim")
+	ioutil.WriteFile(filename, []byte("mine\n"), 0640)
+
+	r.manifest.Revision = "fedcba9876543210"
+	r.manifest.Entries[3] = fileEntry("Application Support/init.vim", "set nocompatible ruler\n", 0640)
+	r.files["Application Support/init.vim"] = "set nocompatible ruler\n"
+
+	s.failed = 0
+	return s, r, filename
+}
+
+func TestSyncConflictNew(t *testing.T) {
+	s, r, filename := conflictSyncer(t, PolicyNew)
+	defer os.RemoveAll(s.root)
+
+	assert.NotNil(t, s.sync(), "The escaping symlink should have been reported")
+
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data), "Local changes were overwritten")
+	data, _ = ioutil.ReadFile(filename + NEWSUFFIX)
+	assert.Equal(t, "set nocompatible ruler\n", string(data), "Update was not saved alongside")
+	assert.Equal(t, []string{"Application Support/init.vim"}, r.conflicts)
+
+	// Once resolved, the server hears that too
+	ioutil.WriteFile(filename, []byte("set nocompatible ruler\n"), 0640)
+	s.conflicts = nil
+	s.sync()
+	assert.Empty(t, r.conflicts)
+	_, err := os.Stat(s.cfg["NETSKEL_CONFLICTS"])
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSyncConflictPolicies(t *testing.T) {
+	s, _, filename := conflictSyncer(t, PolicyKeep)
+	s.sync()
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data))
+	_, err := os.Stat(filename + NEWSUFFIX)
+	assert.True(t, os.IsNotExist(err), "Kept local changes but saved the update anyway")
+	os.RemoveAll(s.root)
+
+	s, _, filename = conflictSyncer(t, PolicyFail)
+	s.sync()
+	assert.Equal(t, 2, s.failed, "Conflict was not a failure")
+	data, _ = ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data))
+	os.RemoveAll(s.root)
+
+	s, r, filename := conflictSyncer(t, PolicyOverwrite)
+	s.sync()
+	data, _ = ioutil.ReadFile(filename)
+	assert.Equal(t, "set nocompatible ruler\n", string(data))
+	assert.Empty(t, r.conflicts)
+	os.RemoveAll(s.root)
+}
+
+func TestSyncConflictUnknownPolicy(t *testing.T) {
+	s, r, filename := conflictSyncer(t, PolicyNew)
+	defer os.RemoveAll(s.root)
+
+	s.cfg["NETSKEL_CONFLICT_POLICY"] = "ask"
+	r.commands = nil
+	assert.NotNil(t, s.sync())
+	assert.Empty(t, r.commands, "Synced with an unknown policy")
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data))
+}
+
+func TestLoadInstalled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "installed")
+	installed := map[string]string{"b": "2", "a dir/a": "1"}
+	assert.Nil(t, saveInstalled(filename, installed))
+	assert.Equal(t, installed, loadInstalled(filename, nil))
+}
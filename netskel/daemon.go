@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// A schedule decides how long the daemon waits before each sync.  Every
+// wait is stretched by a random jitter so a fleet of hosts started together
+// drifts apart, and failures back off exponentially up to the interval.
+type schedule struct {
+	interval time.Duration
+	jitter   time.Duration
+	retry    time.Duration
+	failures int
+	rand     *rand.Rand
+}
+
+// newSchedule reads the daemon settings, seeding the jitter from this host
+// so no two hosts share a sequence.
+func newSchedule(c config) *schedule {
+	seed := int64(crc32.ChecksumIEEE([]byte(clientUUID(c)+hostname()))) ^ time.Now().UnixNano()
+
+	return &schedule{
+		interval: time.Duration(c.Int("NETSKEL_INTERVAL", 86400)) * time.Second,
+		jitter:   time.Duration(c.Int("NETSKEL_JITTER", 3600)) * time.Second,
+		retry:    time.Duration(c.Int("NETSKEL_RETRY", 60)) * time.Second,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// spread returns a random duration below d.
+func (s *schedule) spread(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(s.rand.Int63n(int64(d)))
+}
+
+// first is the wait before the daemon's first sync.
+func (s *schedule) first() time.Duration {
+	return s.spread(s.jitter)
+}
+
+// next is the wait after a sync which ended with err, during which the
+// server may have suggested when to come back.
+func (s *schedule) next(hint time.Duration, err error) time.Duration {
+	if err != nil {
+		s.failures++
+
+		wait := s.retry
+		for i := 1; i < s.failures && wait < s.interval; i++ {
+			wait *= 2
+		}
+		if wait > s.interval {
+			wait = s.interval
+		}
+		return wait + s.spread(wait/10)
+	}
+	s.failures = 0
+
+	wait := s.interval
+	if hint > 0 {
+		wait = hint
+	}
+	if wait < s.retry {
+		wait = s.retry
+	}
+
+	jitter := s.jitter
+	if jitter > wait/10 {
+		jitter = wait / 10
+	}
+	return wait + s.spread(jitter)
+}
+
+// daemonPID returns the process ID of a running daemon, or 0 if there is
+// none.
+func daemonPID(c config) int {
+	if pid := readPID(c["NETSKEL_PIDFILE"]); pid != 0 && alive(pid) {
+		return pid
+	}
+	return 0
+}
+
+// removeCrontab takes out the nightly sync, saying why.
+func removeCrontab(why string) error {
+	current, _ := exec.Command("crontab", "-l").Output()
+	if !strings.Contains(string(current), "netskel sync") {
+		return nil
+	}
+
+	Log("Removing netskel from the crontab, %s", why)
+
+	var lines []string
+	for _, line := range strings.Split(string(current), "\n") {
+		if line != "" && !strings.Contains(line, "netskel sync") {
+			lines = append(lines, line)
+		}
+	}
+
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	return cmd.Run()
+}
+
+// syncOnce runs one scheduled sync, returning the server's suggestion for
+// the next.
+func syncOnce(c config) (time.Duration, error) {
+	if err := lock(c); err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	hook(c["HOME"], "pre-netskel")
+	defer hook(c["HOME"], "post-netskel")
+	defer trimLog(c.Int("NETSKEL_LOGFILE_LIMIT", 512))
+
+	s, err := newSyncer(c)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to connect to %s: %v", c["NETSKEL_SERVER"], err)
+	}
+	defer s.Close()
+
+	err = s.sync()
+	return s.nextSync, err
+}
+
+// daemon syncs on a schedule until it is told to stop.
+func daemon(c config) error {
+	if pid := daemonPID(c); pid != 0 {
+		return fmt.Errorf("netskel daemon is already running as pid %d", pid)
+	}
+
+	if err := ioutil.WriteFile(c["NETSKEL_PIDFILE"], []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600); err != nil {
+		return err
+	}
+	defer os.Remove(c["NETSKEL_PIDFILE"])
+
+	if err := removeCrontab("the daemon syncs instead"); err != nil {
+		Log("Unable to update the crontab: %v", err)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	sched := newSchedule(c)
+	wait := sched.first()
+
+	for {
+		Debug("Next sync in %v", wait.Round(time.Second))
+
+		select {
+		case sig := <-stop:
+			Log("netskel daemon stopping on %v", sig)
+			return nil
+		case <-time.After(wait):
+		}
+
+		hint, err := syncOnce(c)
+		if err != nil {
+			Log("%v", err)
+		}
+		wait = sched.next(hint, err)
+	}
+}
+
+// systemdUnit returns a systemd user unit which runs the daemon from
+// executable.
+func systemdUnit(executable string) string {
+	return fmt.Sprintf(`[Unit]
+Description=netskel environment synchronizer
+
+[Service]
+ExecStart=%s daemon
+Restart=on-failure
+RestartSec=60
+
+[Install]
+WantedBy=default.target
+`, executable)
+}
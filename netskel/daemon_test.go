@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testSchedule() *schedule {
+	return &schedule{
+		interval: 24 * time.Hour,
+		jitter:   time.Hour,
+		retry:    time.Minute,
+		rand:     rand.New(rand.NewSource(1)),
+	}
+}
+
+func TestScheduleJitter(t *testing.T) {
+	s := testSchedule()
+
+	first := s.first()
+	assert.True(t, first >= 0 && first < time.Hour)
+
+	wait := s.next(0, nil)
+	assert.True(t, wait >= 24*time.Hour && wait < 25*time.Hour, "Wait %v is off the interval", wait)
+}
+
+func TestScheduleBackoff(t *testing.T) {
+	s := testSchedule()
+	failed := fmt.Errorf("connection refused")
+
+	var waits []time.Duration
+	for i := 0; i < 3; i++ {
+		waits = append(waits, s.next(0, failed))
+	}
+	assert.True(t, waits[0] >= time.Minute && waits[0] < 66*time.Second)
+	assert.True(t, waits[1] >= 2*time.Minute && waits[1] < 132*time.Second)
+	assert.True(t, waits[2] >= 4*time.Minute && waits[2] < 264*time.Second)
+
+	for i := 0; i < 20; i++ {
+		s.next(0, failed)
+	}
+	assert.True(t, s.next(0, failed) < 24*time.Hour+144*time.Minute, "Backoff grew past the interval")
+
+	wait := s.next(0, nil)
+	assert.Equal(t, 0, s.failures, "Success didn't reset the backoff")
+	assert.True(t, wait >= 24*time.Hour)
+}
+
+func TestScheduleHint(t *testing.T) {
+	s := testSchedule()
+
+	wait := s.next(10*time.Minute, nil)
+	assert.True(t, wait >= 10*time.Minute && wait < 11*time.Minute, "Wait %v ignored the server", wait)
+
+	wait = s.next(time.Second, nil)
+	assert.True(t, wait >= time.Minute, "Server hint undercut the retry floor")
+}
+
+func TestDaemonPID(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := config{"NETSKEL_PIDFILE": filepath.Join(dir, "daemon.pid")}
+	assert.Equal(t, 0, daemonPID(c))
+
+	ioutil.WriteFile(c["NETSKEL_PIDFILE"], []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	assert.Equal(t, os.Getpid(), daemonPID(c))
+
+	ioutil.WriteFile(c["NETSKEL_PIDFILE"], []byte("garbage\n"), 0600)
+	assert.Equal(t, 0, daemonPID(c))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diffLimit caps the work done comparing two files line by line.  Larger
+// files are shown as a wholesale replacement.
+const diffLimit = 4 << 20
+
+// A diffLine is one line of an edit script: kept (' '), removed ('-') or
+// added ('+').
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// splitLines splits data into lines, each keeping its newline.
+func splitLines(data []byte) []string {
+	if len(data) == 0 {
+		return nil
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// editScript turns a into b through the longest common subsequence of
+// their lines.
+func editScript(a, b []string) []diffLine {
+	var script []diffLine
+
+	if len(a)*len(b) > diffLimit {
+		for _, line := range a {
+			script = append(script, diffLine{'-', line})
+		}
+		for _, line := range b {
+			script = append(script, diffLine{'+', line})
+		}
+		return script
+	}
+
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			script = append(script, diffLine{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			script = append(script, diffLine{'-', a[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', b[j]})
+			j++
+		}
+	}
+
+	return script
+}
+
+// hunkRange formats one side of a hunk header.  An empty range names the
+// line before it, as diff -u does.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// unifiedDiff describes how to turn the local version of name into the
+// server's, in the format of diff -u.  It returns "" when they match.
+func unifiedDiff(name string, local, remote []byte, exists bool) string {
+	if bytes.Equal(local, remote) {
+		return ""
+	}
+
+	from := "a/" + name
+	if !exists {
+		from = "/dev/null"
+	}
+
+	if bytes.IndexByte(local, 0) >= 0 || bytes.IndexByte(remote, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s and b/%s differ\n", from, name)
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ b/%s\n", from, name)
+
+	script := editScript(splitLines(local), splitLines(remote))
+
+	for start := 0; start < len(script); {
+		// Find the next change, and the run of changes close enough to
+		// share its hunk
+		first := start
+		for first < len(script) && script[first].op == ' ' {
+			first++
+		}
+		if first == len(script) {
+			break
+		}
+
+		last := first
+		for k := first; k < len(script); k++ {
+			if script[k].op != ' ' {
+				last = k
+			} else if k-last > 2*diffContext {
+				break
+			}
+		}
+
+		from := first - diffContext
+		if from < start {
+			from = start
+		}
+		to := last + diffContext + 1
+		if to > len(script) {
+			to = len(script)
+		}
+
+		// Line numbers of the hunk on each side
+		aStart, bStart := 0, 0
+		for _, l := range script[:from] {
+			if l.op != '+' {
+				aStart++
+			}
+			if l.op != '-' {
+				bStart++
+			}
+		}
+		aCount, bCount := 0, 0
+		for _, l := range script[from:to] {
+			if l.op != '+' {
+				aCount++
+			}
+			if l.op != '-' {
+				bCount++
+			}
+		}
+
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, l := range script[from:to] {
+			out.WriteByte(l.op)
+			out.WriteString(l.text)
+			if !strings.HasSuffix(l.text, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+
+		start = to
+	}
+
+	return out.String()
+}
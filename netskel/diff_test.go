@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	assert.Equal(t, "", unifiedDiff("same", []byte("a\n"), []byte("a\n"), true))
+
+	local := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n"
+	remote := "1\n2\nthree\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13"
+	assert.Equal(t, `--- a/.vimrc
++++ b/.vimrc
+@@ -1,6 +1,6 @@
+ 1
+ 2
+-3
++three
+ 4
+ 5
+ 6
+@@ -10,3 +10,4 @@
+ 10
+ 11
+ 12
++13
+\ No newline at end of file
+`, unifiedDiff(".vimrc", []byte(local), []byte(remote), true))
+
+	assert.Equal(t, `--- /dev/null
++++ b/new
+@@ -0,0 +1,2 @@
++hello
++world
+`, unifiedDiff("new", nil, []byte("hello\nworld\n"), false))
+
+	assert.Equal(t, "Binary files a/blob and b/blob differ\n", unifiedDiff("blob", []byte("a\x00"), []byte("b\x00"), true))
+}
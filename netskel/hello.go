@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PROTOCOL is the newest protocol revision this client speaks.
+const PROTOCOL = 2
+
+// capabilities is what the server said it supports when it said hello, as
+// lists of words keyed by the name leading each line.  A server too old to
+// say hello has none, and gets only what the original shell client sent.
+type capabilities map[string][]string
+
+// hello asks the server what it supports.
+func hello(r remote) capabilities {
+	caps := make(capabilities)
+
+	var out bytes.Buffer
+	if err := r.Run("hello", &out); err != nil || !strings.HasPrefix(out.String(), "NETSKEL\t") {
+		Debug("Server didn't say hello, assuming the original protocol: %v", serverError(out.Bytes(), err))
+		return caps
+	}
+
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) == 2 {
+			caps[fields[0]] = strings.Fields(fields[1])
+		}
+	}
+
+	return caps
+}
+
+// has reports whether the server listed value under key.
+func (c capabilities) has(key, value string) bool {
+	for _, v := range c[key] {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// protocol is the newest protocol revision both ends speak.
+func (c capabilities) protocol() int {
+	proto := 1
+	if len(c["protocol"]) > 0 {
+		proto, _ = strconv.Atoi(c["protocol"][0])
+	}
+
+	switch {
+	case proto > PROTOCOL:
+		return PROTOCOL
+	case proto < 1:
+		return 1
+	}
+	return proto
+}
+
+// command formats a server command line.  Every argument is escaped when
+// the server understands escaping, so paths may hold spaces; otherwise an
+// argument with a space in it can't be sent.  Options are left off for a
+// server which predates them.
+func (c capabilities) command(name string, options url.Values, args ...string) (string, error) {
+	escaped := c.has("arguments", "escaped")
+
+	words := []string{name}
+	if escaped {
+		words = append(words, "--escaped")
+	}
+
+	if len(options) > 0 && len(c["formats"]) == 0 {
+		Debug("Server doesn't take options, leaving them off %s", name)
+		options = nil
+	}
+
+	var keys []string
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range options[key] {
+			words = append(words, "--"+key+"="+c.escape(value))
+		}
+	}
+
+	for _, arg := range args {
+		words = append(words, c.escape(arg))
+	}
+
+	if !escaped {
+		for _, word := range words {
+			if strings.ContainsAny(word, " \t\n") {
+				return "", fmt.Errorf("Server can't take %q, it predates escaped arguments", word)
+			}
+		}
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// escape escapes one word of a command line for a server which understands
+// escaping.
+func (c capabilities) escape(word string) string {
+	if !c.has("arguments", "escaped") {
+		return word
+	}
+
+	// Slashes are safe, and easier to read in the server logs
+	return strings.Replace(url.PathEscape(word), "%2F", "/", -1)
+}
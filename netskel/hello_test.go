@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHello(t *testing.T) {
+	caps := hello(&fakeRemote{})
+	assert.Equal(t, 2, caps.protocol())
+	assert.True(t, caps.has("formats", "json"))
+	assert.True(t, caps.has("commands", "retire"))
+
+	legacy := hello(&fakeRemote{legacy: true})
+	assert.Empty(t, legacy)
+	assert.Equal(t, 1, legacy.protocol())
+
+	assert.Equal(t, PROTOCOL, capabilities{"protocol": {"9"}}.protocol(), "Spoke a protocol newer than this client")
+}
+
+func TestCommandEscapes(t *testing.T) {
+	caps := hello(&fakeRemote{})
+	cmd, err := caps.command("sendbase64", url.Values{"snapshot": {"abc"}}, "db/Application Support/init.vim", "uuid")
+	assert.Nil(t, err)
+	assert.Equal(t, "sendbase64 --escaped --snapshot=abc db/Application%20Support/init.vim uuid", cmd)
+
+	// A server which said hello before escaping and options existed
+	caps = capabilities{"protocol": {"1"}, "commands": {"hello", "netskeldb", "sendbase64"}}
+	cmd, err = caps.command("sendbase64", url.Values{"snapshot": {"abc"}}, "db/.vimrc", "uuid")
+	assert.Nil(t, err)
+	assert.Equal(t, "sendbase64 db/.vimrc uuid", cmd)
+
+	_, err = caps.command("sendbase64", nil, "db/Application Support/init.vim", "uuid")
+	assert.NotNil(t, err, "Sent a path with a space to a server which would split it")
+}
+
+func TestSyncLegacyServer(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	r.legacy = true
+	r.manifest.Entries = append(r.manifest.Entries[:2], fileEntry(".profile", "umask 077\n", 0600))
+	r.files[".profile"] = "umask 077\n"
+	s.caps = hello(r)
+	r.commands = nil
+
+	assert.Nil(t, s.sync())
+	assert.True(t, strings.HasPrefix(r.commands[0], "netskeldb "+s.uuid))
+	data, _ := ioutil.ReadFile(filepath.Join(s.root, ".profile"))
+	assert.Equal(t, "umask 077\n", string(data))
+	for _, cmd := range r.commands {
+		assert.NotContains(t, cmd, "--", "Sent options to a server which predates them")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// unlock releases the client lock, if we hold it.
+var unlock = func() {}
+
+// readPID returns the process ID recorded in filename, or 0.
+func readPID(filename string) int {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0
+	}
+	return pid
+}
+
+// alive reports whether process pid is still running.
+func alive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
+
+// lock takes the client lock shared with the shell client, so only one
+// netskel at a time works on ~/.netskel and the files it manages.  The lock
+// is a directory, holding the process ID of its owner so a lock left by a
+// process which died can be recognized and broken.
+func lock(c config) error {
+	dir := c["NETSKEL_LOCK"]
+	pidfile := filepath.Join(dir, "pid")
+
+	for attempt := 0; attempt < 2; attempt++ {
+		err := os.Mkdir(dir, 0700)
+		if err == nil {
+			if err := ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600); err != nil {
+				os.RemoveAll(dir)
+				return err
+			}
+
+			unlock = func() {
+				if readPID(pidfile) == os.Getpid() {
+					os.RemoveAll(dir)
+				}
+				unlock = func() {}
+			}
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		info, err := os.Stat(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		pid := readPID(pidfile)
+		if pid != 0 && alive(pid) {
+			return fmt.Errorf("Another netskel is in progress as pid %d, try again when it finishes", pid)
+		}
+		if pid == 0 && time.Since(info.ModTime()) < time.Minute {
+			// Its owner may not have written its process ID yet
+			return fmt.Errorf("Another netskel is starting up, try again when it finishes")
+		}
+
+		if broken, err := breakLock(dir, pid, info); err != nil {
+			return err
+		} else if !broken {
+			return fmt.Errorf("Another netskel took over a stale lock, try again when it finishes")
+		}
+	}
+
+	return fmt.Errorf("Unable to take the lock %s", dir)
+}
+
+// breakLock removes the lock at dir, which was found left behind by pid as
+// info.  Others may have found it too, so it is first renamed out of the
+// way, which only one process can do, and put back if it turns out to be a
+// lock taken since.  It reports whether this process broke the lock.
+func breakLock(dir string, pid int, info os.FileInfo) (bool, error) {
+	trash, err := ioutil.TempDir(filepath.Dir(dir), ".netskel-stale-lock")
+	if err != nil {
+		return false, err
+	}
+	defer os.RemoveAll(trash)
+	stale := filepath.Join(trash, "lock")
+
+	if err := os.Rename(dir, stale); err != nil {
+		if os.IsNotExist(err) {
+			// Someone else broke it first
+			return false, nil
+		}
+		return false, err
+	}
+
+	moved, err := os.Stat(stale)
+	if err != nil || !os.SameFile(info, moved) || readPID(filepath.Join(stale, "pid")) != pid {
+		if err := os.Rename(stale, dir); err != nil {
+			Log("Unable to put back the lock %s: %v", dir, err)
+		}
+		return false, nil
+	}
+
+	Log("Removing stale lock left by pid %d", pid)
+	return true, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	c := config{"NETSKEL_LOCK": filepath.Join(dir, "lock")}
+	pidfile := filepath.Join(c["NETSKEL_LOCK"], "pid")
+
+	assert.Nil(t, lock(c))
+	assert.Equal(t, os.Getpid(), readPID(pidfile))
+	assert.NotNil(t, lock(c), "Lock was taken twice")
+
+	unlock()
+	_, err = os.Stat(c["NETSKEL_LOCK"])
+	assert.True(t, os.IsNotExist(err), "Unlock left the lock behind")
+
+	// A lock whose owner has exited is broken
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Run())
+	os.Mkdir(c["NETSKEL_LOCK"], 0700)
+	ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0600)
+
+	assert.Nil(t, lock(c), "Stale lock wasn't broken")
+	assert.Equal(t, os.Getpid(), readPID(pidfile))
+
+	// Unlock leaves a lock someone else has taken
+	ioutil.WriteFile(pidfile, []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0600)
+	unlock()
+	assert.Equal(t, cmd.Process.Pid, readPID(pidfile))
+	os.RemoveAll(c["NETSKEL_LOCK"])
+
+	// A fresh lock without a pid may be mid-creation, an old one is stale
+	os.Mkdir(c["NETSKEL_LOCK"], 0700)
+	assert.NotNil(t, lock(c))
+
+	old := time.Now().Add(-2 * time.Minute)
+	os.Chtimes(c["NETSKEL_LOCK"], old, old)
+	assert.Nil(t, lock(c))
+	unlock()
+}
+
+func TestBreakLockOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	lockdir := filepath.Join(dir, "lock")
+	cmd := exec.Command("true")
+	assert.Nil(t, cmd.Run())
+	os.Mkdir(lockdir, 0700)
+	ioutil.WriteFile(filepath.Join(lockdir, "pid"), []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0600)
+	info, _ := os.Stat(lockdir)
+
+	// Everyone who saw the dead pid tries to break the lock
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		broken int
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := breakLock(lockdir, cmd.Process.Pid, info)
+			assert.Nil(t, err)
+			if ok {
+				mu.Lock()
+				broken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, broken, "Stale lock was not broken exactly once")
+
+	// A lock taken since the dead pid was seen is left alone
+	os.Mkdir(lockdir, 0700)
+	ioutil.WriteFile(filepath.Join(lockdir, "pid"), []byte(fmt.Sprintf("%d\n", os.Getpid())), 0600)
+	ok, err := breakLock(lockdir, cmd.Process.Pid, info)
+	assert.Nil(t, err)
+	assert.False(t, ok, "Broke a lock which was taken over")
+	assert.Equal(t, os.Getpid(), readPID(filepath.Join(lockdir, "pid")))
+
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".netskel-stale-lock*"))
+	assert.Empty(t, leftovers)
+}
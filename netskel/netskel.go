@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// VERSION is the release of this client.
+const VERSION = "3.1.0"
+
+// config holds the NETSKEL_* settings, read from ~/.netskel/config on top of
+// the same defaults the shell client uses.
+type config map[string]string
+
+// defaults returns the settings of a client with no config file.
+func defaults(home string) config {
+	return config{
+		"HOME":                    home,
+		"NETSKEL_LOGFILE":         filepath.Join(home, ".netskel/activity.log"),
+		"NETSKEL_LOGFILE_LIMIT":   "512",
+		"NETSKEL_DBFILE":          filepath.Join(home, ".netskel/dbfile"),
+		"NETSKEL_TMP":             filepath.Join(home, ".netskel/tmp"),
+		"NETSKEL_RC":              filepath.Join(home, ".netskel/config"),
+		"NETSKEL_ROOT":            home,
+		"NETSKEL_IDENTITY":        filepath.Join(home, ".netskel/identity"),
+		"NETSKEL_PORT":            "22",
+		"NETSKEL_DEBUG":           "0",
+		"NETSKEL_RUN_ACTIONS":     "1",
+		"NETSKEL_BACKUPS":         filepath.Join(home, ".netskel/backups"),
+		"NETSKEL_BACKUP_KEEP":     "10",
+		"NETSKEL_ORIGINALS":       filepath.Join(home, ".netskel/originals"),
+		"NETSKEL_INSTALLED":       filepath.Join(home, ".netskel/installed"),
+		"NETSKEL_CONFLICTS":       filepath.Join(home, ".netskel/conflicts"),
+		"NETSKEL_CONFLICT_POLICY": PolicyNew,
+		"NETSKEL_INTERVAL":        "86400",
+		"NETSKEL_JITTER":          "3600",
+		"NETSKEL_RETRY":           "60",
+		"NETSKEL_PIDFILE":         filepath.Join(home, ".netskel/daemon.pid"),
+		"NETSKEL_LOCK":            filepath.Join(home, ".netskel/lock"),
+		"NETSKEL_LASTSYNC":        filepath.Join(home, ".netskel/last-sync"),
+		"NETSKEL_UNMANAGED":       filepath.Join(home, ".netskel/unmanaged"),
+	}
+}
+
+// loadConfig reads the settings for the user whose home directory is home.
+// The config file is a shell fragment, so the simple VAR=value assignments
+// it holds are understood along with quoting and $VAR references.
+func loadConfig(home string) (config, error) {
+	c := defaults(home)
+
+	f, err := os.Open(c["NETSKEL_RC"])
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		line = strings.TrimPrefix(line, "export ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 || strings.ContainsAny(kv[0], " \t") {
+			continue
+		}
+		c[kv[0]] = c.expand(unquote(kv[1]))
+	}
+
+	return c, scanner.Err()
+}
+
+// unquote strips shell quoting and trailing comments from a value.
+func unquote(value string) string {
+	value = strings.TrimSpace(value)
+
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			return value[1 : end+1]
+		}
+	}
+
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
+}
+
+// expand substitutes $VAR references from the settings or the environment.
+func (c config) expand(value string) string {
+	return os.Expand(value, func(key string) string {
+		if v, ok := c[key]; ok {
+			return v
+		}
+		return os.Getenv(key)
+	})
+}
+
+// Int returns a numeric setting, or def if it isn't a number.
+func (c config) Int(key string, def int) int {
+	n, err := strconv.Atoi(c[key])
+	if err != nil {
+		return def
+	}
+	return n
+}
+
+// Bool reports whether a setting is switched on.
+func (c config) Bool(key string) bool {
+	return c.Int(key, 0) != 0
+}
+
+// logfile is the activity log shared with the shell client.
+var logfile string
+
+// debug echoes trace messages to the terminal.
+var debug bool
+
+// record appends a line to the activity log.
+func record(message string) {
+	f, err := os.OpenFile(logfile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "%d %s\n", time.Now().Unix(), message)
+}
+
+// Log reports progress to the user and the activity log.
+func Log(format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	fmt.Println(message)
+	record(message)
+}
+
+// Debug writes a trace message to the activity log, and to the terminal when
+// NETSKEL_DEBUG is set.
+func Debug(format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	if debug {
+		fmt.Println(message)
+	}
+	record(message)
+}
+
+// trimLog keeps only the last limit lines of the activity log.
+func trimLog(limit int) error {
+	data, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= limit {
+		return nil
+	}
+
+	return ioutil.WriteFile(logfile, []byte(strings.Join(lines[len(lines)-limit:], "")), 0600)
+}
+
+// hook runs one of the user's ~/bin/pre-netskel or post-netskel scripts.
+func hook(home, name string) {
+	script := filepath.Join(home, "bin", name)
+	if info, err := os.Stat(script); err != nil || info.Mode()&0111 == 0 {
+		return
+	}
+
+	cmd := exec.Command(script)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		Log("E %s failed: %v", name, err)
+	}
+}
+
+// addCrontab schedules a nightly sync unless one is already in the crontab,
+// or the daemon is scheduling syncs instead.
+func addCrontab(c config) error {
+	if daemonPID(c) != 0 {
+		return nil
+	}
+
+	current, _ := exec.Command("crontab", "-l").Output()
+	if strings.Contains(string(current), "netskel sync") {
+		return nil
+	}
+
+	Log("netskel not found in the crontab, adding it now")
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(current), "\n") {
+		if line != "" && !strings.Contains(line, "netskel") {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, "1 0 * * * "+executable+" sync")
+
+	cmd := exec.Command("crontab", "-")
+	cmd.Stdin = strings.NewReader(strings.Join(lines, "\n") + "\n")
+	return cmd.Run()
+}
+
+// cleanup is the housekeeping done at the end of every command.
+func cleanup(c config) {
+	if err := addCrontab(c); err != nil {
+		Log("Unable to update the crontab: %v", err)
+	}
+
+	Debug("Cleaning the bugs off the wings")
+	trimLog(c.Int("NETSKEL_LOGFILE_LIMIT", 512))
+
+	hook(c["HOME"], "post-netskel")
+}
+
+// die reports a fatal error and exits.
+func die(format string, a ...interface{}) {
+	Log(format, a...)
+	unlock()
+	os.Exit(1)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [ sync [--dry-run] [--diff] | rollback [<sync-id>] | status | daemon | systemd-unit | init | push <hostname> | unmanage <path> | uninstall ]\n", filepath.Base(os.Args[0]))
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find home directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := loadConfig(home)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read %s: %v\n", c["NETSKEL_RC"], err)
+		os.Exit(1)
+	}
+
+	syscall.Umask(077)
+	if err := os.MkdirAll(c["NETSKEL_TMP"], 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create temporary directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	logfile = c["NETSKEL_LOGFILE"]
+	debug = c.Bool("NETSKEL_DEBUG")
+
+	Debug("- - - %s", time.Now().UTC().Format("02-Jan-2006 @ 15:04:05 UTC"))
+
+	switch os.Args[1] {
+	case "sync", "rollback", "init", "push", "uninstall", "unmanage":
+		if err := lock(c); err != nil {
+			die("%v", err)
+		}
+		defer unlock()
+	}
+
+	switch os.Args[1] {
+	case "daemon", "systemd-unit", "status", "unmanage":
+		// The daemon runs the hooks around each of its syncs, and the
+		// others only report
+	default:
+		hook(home, "pre-netskel")
+	}
+
+	switch os.Args[1] {
+	case "sync":
+		flags := flag.NewFlagSet("sync", flag.ExitOnError)
+		dryRun := flags.Bool("dry-run", false, "report what would change without changing it")
+		diff := flags.Bool("diff", false, "show how each file would change, without changing it")
+		flags.Parse(os.Args[2:])
+
+		s, err := newSyncer(c)
+		if err != nil {
+			die("Unable to connect to %s: %v", c["NETSKEL_SERVER"], err)
+		}
+		s.diff = *diff
+		s.dryRun = *dryRun || *diff
+		err = s.sync()
+		s.Close()
+		if err != nil {
+			die("%v", err)
+		}
+		if s.dryRun {
+			// Leave the crontab and hooks alone too
+			return
+		}
+
+	case "rollback":
+		id := ""
+		if len(os.Args) > 2 {
+			id = os.Args[2]
+		}
+		if err := rollback(c, id); err != nil {
+			die("%v", err)
+		}
+
+	case "daemon":
+		if err := daemon(c); err != nil {
+			die("%v", err)
+		}
+		return
+
+	case "systemd-unit":
+		executable, err := os.Executable()
+		if err != nil {
+			die("%v", err)
+		}
+		fmt.Print(systemdUnit(executable))
+		return
+
+	case "init":
+		if err := initClient(c); err != nil {
+			die("ERROR: %v", err)
+		}
+
+	case "push":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		if err := push(c, os.Args[2]); err != nil {
+			die("Unable to push to %s: %v", os.Args[2], err)
+		}
+
+	case "status":
+		if err := status(c); err != nil {
+			die("%v", err)
+		}
+		return
+
+	case "unmanage":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		for _, arg := range os.Args[2:] {
+			if err := unmanage(c, arg); err != nil {
+				die("%v", err)
+			}
+		}
+		return
+
+	case "uninstall":
+		if pid := daemonPID(c); pid != 0 {
+			die("Stop the netskel daemon (pid %d) before uninstalling", pid)
+		}
+
+		var r remote
+		if s, err := newSyncer(c); err != nil {
+			Log("Unable to connect to %s: %v", c["NETSKEL_SERVER"], err)
+		} else {
+			defer s.Close()
+			r = s.remote
+		}
+		if err := uninstall(c, r); err != nil {
+			die("%v", err)
+		}
+		if err := removeCrontab("netskel is uninstalled"); err != nil {
+			Log("Unable to update the crontab: %v", err)
+		}
+		trimLog(c.Int("NETSKEL_LOGFILE_LIMIT", 512))
+		hook(home, "post-netskel")
+		return
+
+	case "version":
+		fmt.Printf("netskel %s\n", VERSION)
+		return
+
+	default:
+		fmt.Fprintf(os.Stderr, "%s: invalid argument -- %s\n", filepath.Base(os.Args[0]), os.Args[1])
+		usage()
+	}
+
+	cleanup(c)
+}
+
+// whoami returns the name of the user running the client.
+func whoami() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
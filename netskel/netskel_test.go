@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadConfig(t *testing.T) {
+	home, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(home)
+
+	os.Mkdir(filepath.Join(home, ".netskel"), 0700)
+	ioutil.WriteFile(filepath.Join(home, ".netskel/config"), []byte(`# Netskel settings
+NETSKEL_SERVER=netskel@netskel.example.com
+export NETSKEL_PORT="2222"
+NETSKEL_ROOT='$HOME/skel'
+NETSKEL_TMP=$HOME/tmp # scratch space
+NETSKEL_DEBUG=1
+`), 0600)
+
+	c, err := loadConfig(home)
+	assert.Nil(t, err)
+	assert.Equal(t, "netskel@netskel.example.com", c["NETSKEL_SERVER"])
+	assert.Equal(t, "2222", c["NETSKEL_PORT"])
+	assert.Equal(t, filepath.Join(home, "tmp"), c["NETSKEL_TMP"])
+	assert.Equal(t, filepath.Join(home, ".netskel/dbfile"), c["NETSKEL_DBFILE"])
+	assert.True(t, c.Bool("NETSKEL_DEBUG"))
+	assert.Equal(t, 512, c.Int("NETSKEL_LOGFILE_LIMIT", 0))
+}
+
+func TestLoadConfigMissing(t *testing.T) {
+	c, err := loadConfig("/this/directory/does/not/exist")
+	assert.Nil(t, err)
+	assert.Equal(t, "22", c["NETSKEL_PORT"])
+}
+
+func TestTrimLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	logfile = filepath.Join(dir, "activity.log")
+	for i := 0; i < 10; i++ {
+		record("line")
+	}
+	record("last")
+
+	assert.Nil(t, trimLog(3))
+	data, _ := ioutil.ReadFile(logfile)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[2], " last")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// initClient asks the server for a new identity for this host.
+func initClient(c config) error {
+	fmt.Println("Initializing netskel host:")
+
+	os.Remove(filepath.Join(c["HOME"], ".netskelrc"))
+
+	identity := c["NETSKEL_IDENTITY"]
+	if _, err := os.Stat(identity); err == nil {
+		return fmt.Errorf("%s already exists\n       Please remove this file if you want to re-init", identity)
+	}
+
+	r, err := dialServer(c, userSigners(c))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var out bytes.Buffer
+	cmd, err := hello(r).command("addkey", nil, whoami(), hostname())
+	if err != nil {
+		return err
+	}
+	if err := r.Run(cmd, &out); err != nil {
+		return serverError(out.Bytes(), err)
+	}
+
+	if err := ioutil.WriteFile(identity, out.Bytes(), 0400); err != nil {
+		return err
+	}
+
+	uuid := clientUUID(c)
+	if uuid == "" {
+		os.Remove(identity)
+		return fmt.Errorf("Failed to receive Client ID and Private Key from Netskel Server")
+	}
+
+	fmt.Printf("\nThe Netskel server assigned client ID: %s\n\n", uuid)
+	return nil
+}
+
+// machines maps GOARCH to the names uname -m reports for it.
+var machines = map[string][]string{
+	"amd64": {"x86_64", "amd64"},
+	"386":   {"i386", "i486", "i586", "i686"},
+	"arm64": {"aarch64", "arm64"},
+	"arm":   {"armv6l", "armv7l", "arm"},
+}
+
+// samePlatform reports whether the uname -sm output of another host
+// describes a host which can run this very binary.
+func samePlatform(uname string) bool {
+	fields := strings.Fields(uname)
+	if len(fields) != 2 || fields[0] != unameOS() {
+		return false
+	}
+
+	for _, machine := range machines[runtime.GOARCH] {
+		if fields[1] == machine {
+			return true
+		}
+	}
+	return fields[1] == runtime.GOARCH
+}
+
+// push installs and initializes netskel for the same user on another host.
+// The new host is given this client when it can run it and the shell
+// client from the server otherwise.  Our SSH agent is forwarded so the new
+// host can reach the server to init.
+func push(c config, target string) error {
+	Log("Pushing netskel to %s", target)
+
+	client, err := dial(target, "22", userSigners(c), filepath.Join(c["HOME"], ".netskel/known_hosts"))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket != "" {
+		if err := agent.ForwardToRemote(client, socket); err != nil {
+			return err
+		}
+	}
+
+	run := func(cmd string, stdin io.Reader, stdout io.Writer) error {
+		session, err := client.NewSession()
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+
+		if socket != "" {
+			agent.RequestAgentForwarding(session)
+		}
+		session.Stdin = stdin
+		session.Stdout = stdout
+		session.Stderr = os.Stderr
+
+		Debug("Running %s on %s", cmd, target)
+		return session.Run(cmd)
+	}
+
+	if err := run(`test -d $HOME/bin || mkdir $HOME/bin; test -d $HOME/.netskel || mkdir $HOME/.netskel; chmod 700 $HOME/bin $HOME/.netskel`, nil, os.Stdout); err != nil {
+		return err
+	}
+
+	rc, err := ioutil.ReadFile(c["NETSKEL_RC"])
+	if err != nil {
+		return err
+	}
+	if err := run(`cat > $HOME/.netskel/config && chmod 600 $HOME/.netskel/config`, bytes.NewReader(rc), os.Stdout); err != nil {
+		return err
+	}
+
+	var uname bytes.Buffer
+	if err := run("uname -sm", nil, &uname); err != nil {
+		return err
+	}
+
+	if samePlatform(uname.String()) {
+		executable, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		binary, err := os.Open(executable)
+		if err != nil {
+			return err
+		}
+		defer binary.Close()
+
+		Log("Copying this client to %s", target)
+		err = run(`cat > $HOME/bin/netskel && chmod 700 $HOME/bin/netskel`, binary, os.Stdout)
+		if err != nil {
+			return err
+		}
+	} else {
+		Log("%s is %s, installing the shell client instead", target, strings.TrimSpace(uname.String()))
+		err := run(fmt.Sprintf("ssh -Atq -p %s -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null %s rawclient > $HOME/bin/netskel && chmod 700 $HOME/bin/netskel", c["NETSKEL_PORT"], c["NETSKEL_SERVER"]), nil, os.Stdout)
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("-- ")
+	err = run(`$HOME/bin/netskel init && $HOME/bin/netskel sync && echo "Netskel INIT Successful"`, nil, os.Stdout)
+	fmt.Println("-- ")
+
+	return err
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// TRAILER marks the end-of-stream line which follows every file payload.
+const TRAILER = "#NETSKEL-EOF"
+
+// A remote runs commands on the netskel server, writing their output to
+// stdout.
+type remote interface {
+	Run(command string, stdout io.Writer) error
+	Close() error
+}
+
+// sshRemote runs commands over a single SSH connection.
+type sshRemote struct {
+	client *ssh.Client
+}
+
+// splitTarget separates a user@host[:port] destination into the user and the
+// address to dial.
+func splitTarget(target, port string) (string, string) {
+	username := whoami()
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		username, target = target[:i], target[i+1:]
+	}
+
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, port)
+	}
+
+	return username, target
+}
+
+// dial connects to target as a user@host[:port] destination.
+func dial(target, port string, signers []ssh.Signer, knownHosts string) (*ssh.Client, error) {
+	username, address := splitTarget(target, port)
+
+	return ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signers...)},
+		HostKeyCallback: trustOnFirstUse(knownHosts),
+		Timeout:         30 * time.Second,
+	})
+}
+
+// dialServer connects to the netskel server configured in c.
+func dialServer(c config, signers []ssh.Signer) (*sshRemote, error) {
+	if c["NETSKEL_SERVER"] == "" {
+		return nil, fmt.Errorf("NETSKEL_SERVER is not set in %s", c["NETSKEL_RC"])
+	}
+
+	client, err := dial(c["NETSKEL_SERVER"], c["NETSKEL_PORT"], signers, filepath.Join(c["HOME"], ".netskel/known_hosts"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sshRemote{client: client}, nil
+}
+
+func (r *sshRemote) Run(command string, stdout io.Writer) error {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stdout = stdout
+	session.Stderr = &stderr
+
+	Debug("Running %s", command)
+	if err := session.Run(command); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (r *sshRemote) Close() error {
+	return r.client.Close()
+}
+
+// trustOnFirstUse accepts and remembers the key of a host seen for the
+// first time, and afterwards insists on that same key.
+func trustOnFirstUse(filename string) ssh.HostKeyCallback {
+	return func(hostname string, address net.Addr, key ssh.PublicKey) error {
+		if _, err := os.Stat(filename); err == nil {
+			known, err := knownhosts.New(filename)
+			if err != nil {
+				return err
+			}
+
+			err = known(hostname, address, key)
+			if keyErr, ok := err.(*knownhosts.KeyError); !ok || len(keyErr.Want) > 0 {
+				return err
+			}
+		}
+
+		Debug("Remembering the host key of %s", hostname)
+		f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}
+}
+
+// identitySigners loads the key the server issued to this client.  It is
+// the only key offered to the server, so keys from the user's agent or
+// ~/.ssh never stand in for it.
+func identitySigners(c config) ([]ssh.Signer, error) {
+	data, err := ioutil.ReadFile(c["NETSKEL_IDENTITY"])
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", c["NETSKEL_IDENTITY"], err)
+	}
+
+	return []ssh.Signer{signer}, nil
+}
+
+// userSigners returns the keys the user would log in with anywhere else:
+// those held by their SSH agent and their unencrypted default keys.
+func userSigners(c config) []ssh.Signer {
+	var signers []ssh.Signer
+
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if conn, err := net.Dial("unix", socket); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil {
+				signers = append(signers, agentSigners...)
+			}
+		}
+	}
+
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := ioutil.ReadFile(filepath.Join(c["HOME"], ".ssh", name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+
+	return signers
+}
+
+// clientUUID finds the client ID recorded in the identity file.
+func clientUUID(c config) string {
+	data, err := ioutil.ReadFile(c["NETSKEL_IDENTITY"])
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[1] == "CLIENT_UUID" {
+			return fields[2]
+		}
+	}
+
+	return ""
+}
+
+// serverError turns an ERROR line from the server into an error.
+func serverError(output []byte, err error) error {
+	line := strings.SplitN(string(output), "\n", 2)[0]
+	if strings.HasPrefix(line, "ERROR ") {
+		return fmt.Errorf("Server said: %s", strings.TrimPrefix(line, "ERROR "))
+	}
+
+	return err
+}
+
+// fetchManifest asks the server for the manifest, passing along the
+// revision we already hold and facts describing this host in options.
+func fetchManifest(r remote, caps capabilities, options url.Values, uuid string) (*manifest.Manifest, error) {
+	var out bytes.Buffer
+
+	cmd, err := caps.command("netskeldb", options, uuid, whoami(), hostname())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Run(cmd, &out); err != nil {
+		return nil, serverError(out.Bytes(), err)
+	}
+
+	m, err := manifest.Parse(&out)
+	if err != nil {
+		return nil, serverError(out.Bytes(), err)
+	}
+
+	return m, nil
+}
+
+// fetchFile downloads the file at name as of snapshot, checking it against
+// the trailer the server sends after it.
+func fetchFile(r remote, caps capabilities, snapshot, name, uuid string) ([]byte, error) {
+	var out bytes.Buffer
+
+	options := url.Values{}
+	if snapshot != "" {
+		options.Set("snapshot", snapshot)
+	}
+
+	cmd, err := caps.command("sendbase64", options, "db/"+name, uuid, whoami(), hostname())
+	if err != nil {
+		return nil, err
+	}
+	if err := r.Run(cmd, &out); err != nil {
+		return nil, serverError(out.Bytes(), err)
+	}
+
+	var (
+		encoded bytes.Buffer
+		trailer string
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(out.Bytes()))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, TRAILER) {
+			trailer = line
+			continue
+		}
+		encoded.WriteString(line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if trailer == "" {
+		return nil, serverError(out.Bytes(), fmt.Errorf("transfer was truncated"))
+	}
+
+	data, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Split(trailer, "\t")
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("malformed trailer %q", trailer)
+	}
+	if size, _ := strconv.Atoi(fields[1]); size != len(data) {
+		return nil, fmt.Errorf("transfer size doesn't match")
+	}
+	if fmt.Sprintf("%x", md5.Sum(data)) != fields[2] {
+		return nil, fmt.Errorf("transfer MD5 hash doesn't match")
+	}
+
+	return data, nil
+}
+
+// hostname returns the name this host reports to the server.
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
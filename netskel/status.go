@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// saveLastSync records when a sync last completed without errors.
+func saveLastSync(filename string, t time.Time) error {
+	return ioutil.WriteFile(filename, []byte(fmt.Sprintf("%d\n", t.Unix())), 0600)
+}
+
+// lastSync returns when a sync last completed without errors, or the zero
+// time if none has.
+func lastSync(filename string) time.Time {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return time.Time{}
+	}
+
+	secs, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || secs <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(secs, 0)
+}
+
+// localChanges lists the managed files which were changed since sync last
+// installed them.
+func localChanges(c config, previous *manifest.Manifest) []string {
+	s := &syncer{cfg: c, root: c["NETSKEL_ROOT"]}
+
+	unmanaged := loadUnmanaged(c["NETSKEL_UNMANAGED"])
+
+	var changed []string
+	for name, hash := range loadInstalled(c["NETSKEL_INSTALLED"], previous) {
+		fullpath, err := s.localPath(name)
+		if err != nil || isUnmanaged(unmanaged, name) {
+			continue
+		}
+		if local, err := fileHash(fullpath); err == nil && local != hash {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+// pendingChanges lists what a sync would change now, from a freshly fetched
+// manifest.
+func (s *syncer) pendingChanges() ([]string, error) {
+	s.dryRun = true
+	s.status = true
+	s.pending = nil
+
+	err := s.sync()
+	return s.pending, err
+}
+
+// status describes this client: who it is, when it last synced, what has
+// been changed here and what the next sync would change.
+func status(c config) error {
+	fmt.Printf("Client ID:  %s\n", clientUUID(c))
+	fmt.Printf("Server:     %s\n", c["NETSKEL_SERVER"])
+
+	if t := lastSync(c["NETSKEL_LASTSYNC"]); t.IsZero() {
+		fmt.Printf("Last sync:  never\n")
+	} else {
+		fmt.Printf("Last sync:  %s (%v ago)\n", t.Local().Format("02-Jan-2006 @ 15:04:05 MST"), time.Since(t).Round(time.Second))
+	}
+
+	previous := loadDB(c["NETSKEL_DBFILE"])
+	if previous != nil && previous.Revision != "" {
+		fmt.Printf("Revision:   %s\n", previous.Revision)
+	} else {
+		fmt.Printf("Revision:   none\n")
+	}
+
+	changed := localChanges(c, previous)
+	fmt.Printf("\nLocally modified (%d):\n", len(changed))
+	for _, name := range changed {
+		fmt.Printf("  M %s\n", name)
+	}
+
+	s, err := newSyncer(c)
+	if err != nil {
+		return fmt.Errorf("Unable to connect to %s: %v", c["NETSKEL_SERVER"], err)
+	}
+	defer s.Close()
+
+	pending, err := s.pendingChanges()
+	if err != nil && len(pending) == 0 {
+		return err
+	}
+	fmt.Printf("\nPending updates (%d):\n", len(pending))
+	for _, change := range pending {
+		fmt.Printf("  %s\n", change)
+	}
+
+	if err == nil && len(pending) == 0 {
+		fmt.Println("\nUp to date")
+	}
+	return err
+}
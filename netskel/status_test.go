@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatus(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	// Drop the escaping symlink so the sync succeeds
+	r.manifest.Entries = append(r.manifest.Entries[:5], r.manifest.Entries[6:]...)
+
+	assert.True(t, lastSync(s.cfg["NETSKEL_LASTSYNC"]).IsZero())
+	assert.Nil(t, s.sync())
+	assert.False(t, lastSync(s.cfg["NETSKEL_LASTSYNC"]).IsZero(), "Successful sync wasn't recorded")
+
+	pending, err := s.pendingChanges()
+	assert.Nil(t, err)
+	assert.Empty(t, pending)
+
+	ioutil.WriteFile(filepath.Join(s.root, "Application Support/init.vim"), []byte("mine\n"), 0640)
+	assert.Equal(t, []string{"Application Support/init.vim"}, localChanges(s.cfg, loadDB(s.cfg["NETSKEL_DBFILE"])))
+
+	r.manifest.Revision = "fedcba9876543210"
+	r.manifest.Entries = append(r.manifest.Entries, fileEntry(".profile", "umask 077\n", 0600))
+	r.commands = nil
+
+	pending, err = s.pendingChanges()
+	assert.Nil(t, err)
+	assert.Contains(t, pending, "create .profile")
+	assert.Contains(t, r.commands[0], "--dry-run")
+	assert.Equal(t, "0123456789abcdef", loadDB(s.cfg["NETSKEL_DBFILE"]).Revision, "Status saved the new dbfile")
+}
@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// CLIENTPATH is the shell client which the server injects into every
+// manifest.  This client looks after its own binary, so it is never synced.
+const CLIENTPATH = "bin/netskel"
+
+// A syncer brings the files beneath the client root in line with the
+// manifest on the server.
+type syncer struct {
+	cfg     config
+	remote  remote
+	caps    capabilities
+	uuid    string
+	root    string
+	actions []string
+	failed  int
+
+	// dryRun reports what a sync would change without changing it, and
+	// diff adds the changes to each file's content.
+	dryRun bool
+	diff   bool
+
+	// status collects what a dry run would change in pending rather than
+	// printing it.
+	status  bool
+	pending []string
+
+	// backup saves what this sync replaces, if backups are kept, and
+	// originals what was at each path before netskel first touched it.
+	backup    *backup
+	originals *backup
+
+	// installed holds the hash sync last installed at each path, and
+	// conflicts the paths held back because they were changed locally.
+	installed map[string]string
+	conflicts []string
+
+	// unmanaged holds the paths this host no longer lets sync touch.
+	unmanaged map[string]bool
+
+	// nextSync is how long the server would like us to wait before the
+	// next sync, if it said.
+	nextSync time.Duration
+}
+
+// newSyncer connects to the server using the client's identity.
+func newSyncer(c config) (*syncer, error) {
+	signers, err := identitySigners(c)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := dialServer(c, signers)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syncer{cfg: c, remote: r, caps: hello(r), uuid: clientUUID(c), root: c["NETSKEL_ROOT"]}, nil
+}
+
+func (s *syncer) Close() error {
+	return s.remote.Close()
+}
+
+// unameOS returns what uname -s reports on this operating system.
+func unameOS() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "Darwin"
+	case "freebsd":
+		return "FreeBSD"
+	case "netbsd":
+		return "NetBSD"
+	case "openbsd":
+		return "OpenBSD"
+	case "dragonfly":
+		return "DragonFly"
+	case "solaris", "illumos":
+		return "SunOS"
+	}
+	return strings.Title(runtime.GOOS)
+}
+
+// facts describes this host so the server can deliver files where they
+// belong.
+func (s *syncer) facts() []string {
+	facts := []string{"os=" + unameOS()}
+
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); strings.HasPrefix(xdg, s.root+"/") {
+		facts = append(facts, "xdg_config_home="+strings.TrimPrefix(xdg, s.root+"/"))
+	}
+
+	return facts
+}
+
+// loadDB reads the manifest saved by the previous sync, which may have been
+// written by either client.
+func loadDB(filename string) *manifest.Manifest {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	m, err := manifest.Parse(f)
+	if err != nil {
+		Debug("Ignoring unreadable %s: %v", filename, err)
+		return nil
+	}
+
+	return m
+}
+
+// saveDB keeps m for the next sync.
+func saveDB(filename string, m *manifest.Manifest) error {
+	var buf bytes.Buffer
+	if err := m.WriteJSON(&buf); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filename, buf.Bytes(), 0600)
+}
+
+// localPath returns where the entry at name lives on this host.  Names
+// which would escape the client root are refused.
+func (s *syncer) localPath(name string) (string, error) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s is outside of %s", name, s.root)
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+// fileHash returns the MD5 fingerprint of a local file.
+func fileHash(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// sync fetches the manifest and applies every entry in it.
+func (s *syncer) sync() error {
+	if err := checkPolicy(s.cfg["NETSKEL_CONFLICT_POLICY"]); err != nil {
+		return err
+	}
+
+	dbfile := s.cfg["NETSKEL_DBFILE"]
+	previous := loadDB(dbfile)
+
+	options := url.Values{"proto": {strconv.Itoa(s.caps.protocol())}, "fact": s.facts()}
+	if s.caps.has("formats", "json") {
+		options.Set("format", "json")
+	}
+	if previous != nil && previous.Revision != "" {
+		options.Set("since", previous.Revision)
+	}
+	if s.dryRun {
+		options.Set("dry-run", "")
+	}
+
+	m, err := fetchManifest(s.remote, s.caps, options, s.uuid)
+	if err != nil {
+		return fmt.Errorf("Unable to fetch dbfile: %v", err)
+	}
+	s.nextSync = time.Duration(m.NextSync) * time.Second
+
+	if m.NotModified && previous != nil {
+		Debug("dbfile unchanged at revision %s", m.Revision)
+		m = previous
+	} else if s.dryRun {
+		Debug("Not saving dbfile revision %s in a dry run", m.Revision)
+	} else if err := saveDB(dbfile, m); err != nil {
+		return fmt.Errorf("Unable to save dbfile: %v", err)
+	}
+
+	s.installed = loadInstalled(s.cfg["NETSKEL_INSTALLED"], previous)
+	s.unmanaged = loadUnmanaged(s.cfg["NETSKEL_UNMANAGED"])
+
+	if !s.dryRun {
+		s.originals = &backup{dir: s.cfg["NETSKEL_ORIGINALS"]}
+	}
+	if keep := s.cfg.Int("NETSKEL_BACKUP_KEEP", 10); keep != 0 && !s.dryRun {
+		s.backup = &backup{dir: filepath.Join(s.cfg["NETSKEL_BACKUPS"], syncID(s.cfg["NETSKEL_BACKUPS"], time.Now()))}
+		defer pruneBackups(s.cfg["NETSKEL_BACKUPS"], keep)
+	}
+
+	// Files and directories first, so symlinks have something to point
+	// at, and removals last
+	for _, types := range [][]string{
+		{manifest.TypeDir, manifest.TypeFile},
+		{manifest.TypeSymlink},
+	} {
+		for _, e := range m.Entries {
+			for _, t := range types {
+				if e.Type == t {
+					s.apply(m, e)
+				}
+			}
+		}
+	}
+
+	// Deepest first, so a removed directory is empty by the time its own
+	// tombstone comes up
+	for i := len(m.Entries) - 1; i >= 0; i-- {
+		if m.Entries[i].Type == manifest.TypeTombstone {
+			s.apply(m, m.Entries[i])
+		}
+	}
+
+	s.runActions()
+
+	if !s.dryRun {
+		if err := saveInstalled(s.cfg["NETSKEL_INSTALLED"], s.installed); err != nil {
+			Log("Unable to save %s: %v", s.cfg["NETSKEL_INSTALLED"], err)
+		}
+		s.reportConflicts()
+	}
+
+	if s.failed > 0 {
+		return fmt.Errorf("%d entries could not be synced", s.failed)
+	}
+
+	if !s.dryRun {
+		if err := saveLastSync(s.cfg["NETSKEL_LASTSYNC"], time.Now()); err != nil {
+			Log("Unable to save %s: %v", s.cfg["NETSKEL_LASTSYNC"], err)
+		}
+	}
+	return nil
+}
+
+// apply brings one entry up to date, logging any failure.
+func (s *syncer) apply(m *manifest.Manifest, e manifest.Entry) {
+	if e.Path == CLIENTPATH {
+		return
+	}
+	if isUnmanaged(s.unmanaged, e.Path) {
+		Debug("Skipping unmanaged %s", e.Path)
+		return
+	}
+
+	fullpath, err := s.localPath(e.Path)
+	if err == nil {
+		switch e.Type {
+		case manifest.TypeDir:
+			err = s.syncDir(fullpath, e)
+		case manifest.TypeFile:
+			err = s.syncFile(fullpath, m.Revision, e)
+		case manifest.TypeSymlink:
+			err = s.syncSymlink(fullpath, e)
+		case manifest.TypeTombstone:
+			err = s.removeFile(fullpath, e)
+		}
+	}
+
+	if err != nil {
+		Log("E %s %v", e.Path, err)
+		s.failed++
+	}
+}
+
+// report tells the user about a change a dry run would have made.
+func (s *syncer) report(format string, a ...interface{}) {
+	if s.status {
+		s.pending = append(s.pending, fmt.Sprintf(format, a...))
+		return
+	}
+	fmt.Printf("would "+format+"\n", a...)
+}
+
+func (s *syncer) syncDir(fullpath string, e manifest.Entry) error {
+	if _, err := os.Stat(fullpath); os.IsNotExist(err) {
+		if s.dryRun {
+			s.report("create %s/", e.Path)
+			return nil
+		}
+		Log("C %s/", e.Path)
+		if err := os.MkdirAll(fullpath, 0700); err != nil {
+			return err
+		}
+	}
+
+	return s.setMode(fullpath, e)
+}
+
+func (s *syncer) syncFile(fullpath, snapshot string, e manifest.Entry) error {
+	local := ""
+	if info, err := os.Lstat(fullpath); err == nil && info.Mode().IsRegular() {
+		local, _ = fileHash(fullpath)
+	}
+
+	if local == e.Hash {
+		s.installed[e.Path] = e.Hash
+		return s.setMode(fullpath, e)
+	}
+
+	// Changed here since sync last installed it, as well as on the server
+	if known := s.installed[e.Path]; local != "" && known != "" && local != known {
+		overwrite, err := s.resolve(fullpath, snapshot, e)
+		if !overwrite {
+			return err
+		}
+	}
+
+	if s.dryRun {
+		return s.reportFile(fullpath, snapshot, e)
+	}
+
+	data, err := s.fetch(snapshot, e)
+	if err != nil {
+		return fmt.Errorf("not installed: %v", err)
+	}
+
+	if err := s.save(e.Path, fullpath); err != nil {
+		return fmt.Errorf("not installed, unable to back it up: %v", err)
+	}
+	if err := s.install(fullpath, data, e); err != nil {
+		return fmt.Errorf("not installed: %v", err)
+	}
+	Log("U %s", e.Path)
+	s.installed[e.Path] = e.Hash
+
+	if action := e.Meta[manifest.MetaRun]; action != "" {
+		s.actions = append(s.actions, action)
+	}
+
+	return nil
+}
+
+// save backs up the path at fullpath before sync replaces or removes it.
+func (s *syncer) save(name, fullpath string) error {
+	if err := s.original(name, fullpath); err != nil {
+		return err
+	}
+	if s.backup == nil {
+		return nil
+	}
+
+	return s.backup.save(name, fullpath)
+}
+
+// original keeps what was at fullpath before netskel first touched it, for
+// uninstall.  A path sync installed before originals were kept holds
+// nothing of the user's any more, so it is noted as netskel's own.
+func (s *syncer) original(name, fullpath string) error {
+	if s.originals == nil || s.originals.lookup(name) != "" {
+		return nil
+	}
+	if _, ok := s.installed[name]; ok {
+		return s.originals.record("C", name)
+	}
+
+	return s.originals.save(name, fullpath)
+}
+
+// install puts data in place at fullpath as the file e describes.  It is
+// written to a temporary file in the same directory, flushed to disk and
+// checked against e before being renamed into place, so fullpath is either
+// fully updated or left untouched.
+func (s *syncer) install(fullpath string, data []byte, e manifest.Entry) error {
+	dir := filepath.Dir(fullpath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".netskel-"+filepath.Base(fullpath)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(tmp.Name()); err != nil || info.Size() != e.Size {
+		return fmt.Errorf("written size doesn't match the manifest")
+	}
+	if hash, err := fileHash(tmp.Name()); err != nil || hash != e.Hash {
+		return fmt.Errorf("written content doesn't match the manifest")
+	}
+
+	if err := chmod(tmp.Name(), e.Mode); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fullpath)
+}
+
+// fetch downloads the file for e, making sure it is what the manifest
+// describes.
+func (s *syncer) fetch(snapshot string, e manifest.Entry) ([]byte, error) {
+	Debug("Fetching file %s", e.Path)
+	data, err := fetchFile(s.remote, s.caps, snapshot, e.Path, s.uuid)
+	if err != nil {
+		return nil, err
+	}
+	if hash := fmt.Sprintf("%x", md5.Sum(data)); hash != e.Hash {
+		return nil, fmt.Errorf("content doesn't match the manifest")
+	}
+
+	return data, nil
+}
+
+// reportFile describes the file a sync would install at fullpath, along with
+// how its content would change when a diff was asked for.
+func (s *syncer) reportFile(fullpath, snapshot string, e manifest.Entry) error {
+	if _, err := os.Lstat(fullpath); err == nil {
+		s.report("update %s", e.Path)
+	} else {
+		s.report("create %s", e.Path)
+	}
+
+	if action := e.Meta[manifest.MetaRun]; action != "" {
+		s.actions = append(s.actions, action)
+	}
+
+	return s.showDiff(fullpath, snapshot, e)
+}
+
+// showDiff prints how the file at fullpath would change, if a diff was
+// asked for.
+func (s *syncer) showDiff(fullpath, snapshot string, e manifest.Entry) error {
+	if !s.diff {
+		return nil
+	}
+
+	local, err := ioutil.ReadFile(fullpath)
+	exists := err == nil
+
+	remote, err := s.fetch(snapshot, e)
+	if err != nil {
+		return fmt.Errorf("unable to diff: %v", err)
+	}
+	fmt.Print(unifiedDiff(e.Path, local, remote, exists))
+
+	return nil
+}
+
+// setMode gives the entry at fullpath the mode the manifest asks for.
+func (s *syncer) setMode(fullpath string, e manifest.Entry) error {
+	if !s.dryRun {
+		return chmod(fullpath, e.Mode)
+	}
+
+	info, err := os.Stat(fullpath)
+	if err != nil || e.Mode == 0 {
+		return nil
+	}
+	if mode := uint32(info.Mode().Perm()); mode != e.Mode&uint32(os.ModePerm) {
+		s.report("chmod %s %o -> %o", e.Path, mode, e.Mode&uint32(os.ModePerm))
+	}
+
+	return nil
+}
+
+// chmod sets the mode the manifest asks for, if it gave one.
+func chmod(fullpath string, mode uint32) error {
+	if mode == 0 {
+		return nil
+	}
+
+	return os.Chmod(fullpath, os.FileMode(mode)&os.ModePerm)
+}
+
+func (s *syncer) syncSymlink(fullpath string, e manifest.Entry) error {
+	if !manifest.Contained(e.Path, e.Target) {
+		return fmt.Errorf("points outside of %s, not linking it", s.root)
+	}
+
+	if info, err := os.Lstat(fullpath); err == nil {
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			if target, _ := os.Readlink(fullpath); target == e.Target {
+				return nil
+			}
+		case info.IsDir():
+			return fmt.Errorf("is a directory, not replacing it with a symlink")
+		}
+	}
+
+	if s.dryRun {
+		s.report("link %s -> %s", e.Path, e.Target)
+		return nil
+	}
+
+	if err := s.save(e.Path, fullpath); err != nil {
+		return fmt.Errorf("not linked, unable to back it up: %v", err)
+	}
+	if err := os.Remove(fullpath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	Debug("Linking %s to %s", e.Path, e.Target)
+	if err := os.Symlink(e.Target, fullpath); err != nil {
+		return err
+	}
+	Log("L %s", e.Path)
+
+	return nil
+}
+
+// removeFile deletes a file, symlink or directory which is no longer on the
+// server, as long as it is still exactly what the server sent.  Tombstones
+// for files carry a hash, those for symlinks their target, and directories
+// are only removed once empty.
+func (s *syncer) removeFile(fullpath string, e manifest.Entry) error {
+	info, err := os.Lstat(fullpath)
+	if err != nil {
+		return nil
+	}
+
+	switch {
+	case e.Hash == "" && info.IsDir():
+		return s.removeDir(fullpath, e)
+	case e.Hash == "" && info.Mode()&os.ModeSymlink != 0:
+		if target, _ := os.Readlink(fullpath); e.Target == "" || target != e.Target {
+			Debug("%s was removed from the server but relinked locally, keeping it", e.Path)
+			return nil
+		}
+	case e.Hash != "" && info.Mode().IsRegular():
+		hash, err := fileHash(fullpath)
+		if err != nil {
+			return err
+		}
+		if hash != e.Hash {
+			Debug("%s was removed from the server but changed locally, keeping it", e.Path)
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	if s.dryRun {
+		s.report("remove %s", e.Path)
+		return nil
+	}
+	if err := s.save(e.Path, fullpath); err != nil {
+		return fmt.Errorf("not removed, unable to back it up: %v", err)
+	}
+	if err := os.Remove(fullpath); err != nil {
+		return err
+	}
+	Log("R %s", e.Path)
+	delete(s.installed, e.Path)
+
+	return nil
+}
+
+// removeDir deletes a directory which is no longer on the server, unless
+// something is still in it.
+func (s *syncer) removeDir(fullpath string, e manifest.Entry) error {
+	names, err := ioutil.ReadDir(fullpath)
+	if err != nil {
+		return err
+	}
+	if len(names) > 0 {
+		Debug("%s/ was removed from the server but isn't empty, keeping it", e.Path)
+		return nil
+	}
+
+	if s.dryRun {
+		s.report("remove %s/", e.Path)
+		return nil
+	}
+	if err := os.Remove(fullpath); err != nil {
+		return err
+	}
+	Log("R %s/", e.Path)
+
+	return nil
+}
+
+// runActions runs each queued action once, in the order the files they
+// belong to were updated.
+func (s *syncer) runActions() {
+	seen := make(map[string]bool)
+
+	for _, action := range s.actions {
+		if seen[action] {
+			continue
+		}
+		seen[action] = true
+
+		if !s.cfg.Bool("NETSKEL_RUN_ACTIONS") {
+			Debug("Skipping action %s", action)
+			continue
+		}
+		if s.dryRun {
+			s.report("run %s", action)
+			continue
+		}
+
+		Log("A %s", action)
+		cmd := exec.Command("/bin/sh", "-c", action)
+		cmd.Dir = s.root
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			Log("E action failed: %s", action)
+		}
+	}
+
+	s.actions = nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRemote plays the part of the server, answering with a fixed manifest
+// and file contents.
+type fakeRemote struct {
+	manifest *manifest.Manifest
+	files    map[string]string
+	commands []string
+
+	// conflicts holds the paths last reported by the client, and retired
+	// whether it has uninstalled.
+	conflicts []string
+	retired   bool
+
+	// legacy plays a server too old to say hello.
+	legacy bool
+}
+
+func (f *fakeRemote) Run(command string, stdout io.Writer) error {
+	f.commands = append(f.commands, command)
+
+	words := strings.Split(command, " ")
+	var args []string
+	options := url.Values{}
+	for _, word := range words[1:] {
+		word, _ = url.PathUnescape(word)
+		if strings.HasPrefix(word, "--") {
+			kv := strings.SplitN(strings.TrimPrefix(word, "--"), "=", 2)
+			options.Add(kv[0], strings.Join(kv[1:], ""))
+			continue
+		}
+		args = append(args, word)
+	}
+
+	if f.legacy && words[0] != "netskeldb" && words[0] != "sendbase64" {
+		fmt.Fprintln(stdout, "ERROR Syntax error")
+		return fmt.Errorf("exit status 1")
+	}
+
+	switch words[0] {
+	case "hello":
+		fmt.Fprintf(stdout, "NETSKEL\ttest\tserver\nprotocol\t2\nhashes\tmd5\nencodings\tbase64 hex raw\n")
+		fmt.Fprintf(stdout, "formats\ttsv json\narguments\tescaped\ncommands\thello netskeldb sendbase64 conflicts retire\n")
+		return nil
+	case "netskeldb":
+		m := *f.manifest
+		if options.Get("since") == m.Revision {
+			m.NotModified = true
+			m.Entries = nil
+		}
+		if options.Get("format") != "json" {
+			return m.WriteTSV(stdout)
+		}
+		return m.WriteJSON(stdout)
+	case "sendbase64":
+		content, ok := f.files[strings.TrimPrefix(args[0], "db/")]
+		if !ok {
+			fmt.Fprintf(stdout, "ERROR 404 Unable to find %s\n", args[0])
+			return fmt.Errorf("exit status 1")
+		}
+		fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString([]byte(content)))
+		fmt.Fprintf(stdout, "%s\t%d\t%x\n", TRAILER, len(content), md5.Sum([]byte(content)))
+		return nil
+	case "conflicts":
+		f.conflicts = options["path"]
+		return nil
+	case "retire":
+		f.retired = true
+		return nil
+	}
+
+	return fmt.Errorf("unexpected command %s", command)
+}
+
+func (f *fakeRemote) Close() error {
+	return nil
+}
+
+func fileEntry(name, content string, mode uint32) manifest.Entry {
+	return manifest.Entry{
+		Path: name,
+		Type: manifest.TypeFile,
+		Mode: mode,
+		Size: int64(len(content)),
+		Hash: fmt.Sprintf("%x", md5.Sum([]byte(content))),
+	}
+}
+
+// testSyncer returns a syncer for a scratch home directory, talking to a
+// fake server holding a few files.
+func testSyncer(t *testing.T) (*syncer, *fakeRemote) {
+	home, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+
+	c := defaults(home)
+	os.MkdirAll(c["NETSKEL_TMP"], 0700)
+	logfile = c["NETSKEL_LOGFILE"]
+
+	m := manifest.New()
+	m.Revision = "0123456789abcdef"
+	m.Entries = []manifest.Entry{
+		{Path: "bin", Type: manifest.TypeDir, Mode: 0700},
+		fileEntry("bin/netskel", "#!/bin/sh\n", 0700),
+		{Path: "Application Support", Type: manifest.TypeDir, Mode: 0750},
+		fileEntry("Application Support/init.vim", "set nocompatible\n", 0640),
+		{Path: ".vimrc", Type: manifest.TypeSymlink, Mode: 0777, Target: "Application Support/init.vim"},
+		{Path: ".escape", Type: manifest.TypeSymlink, Mode: 0777, Target: "../../etc/passwd"},
+		fileEntry(".oldrc", "old\n", 0600),
+	}
+	m.Entries[6].Type = manifest.TypeTombstone
+
+	r := &fakeRemote{
+		manifest: m,
+		files: map[string]string{
+			"bin/netskel":                  "#!/bin/sh\n",
+			"Application Support/init.vim": "set nocompatible\n",
+		},
+	}
+
+	s := &syncer{cfg: c, remote: r, caps: hello(r), uuid: "6ec558e1-5f06-4083-9070-206819b53916", root: home}
+	r.commands = nil
+
+	return s, r
+}
+
+func TestSync(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	ioutil.WriteFile(filepath.Join(s.root, ".oldrc"), []byte("old\n"), 0600)
+
+	err := s.sync()
+	assert.NotNil(t, err, "The escaping symlink should have been reported")
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.Nil(t, err)
+	assert.Equal(t, "set nocompatible\n", string(data))
+
+	info, _ := os.Stat(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	info, _ = os.Stat(filepath.Join(s.root, "Application Support"))
+	assert.Equal(t, os.FileMode(0750), info.Mode().Perm())
+
+	target, err := os.Readlink(filepath.Join(s.root, ".vimrc"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Application Support/init.vim", target)
+
+	_, err = os.Lstat(filepath.Join(s.root, ".escape"))
+	assert.True(t, os.IsNotExist(err), "Linked outside of the root")
+
+	_, err = os.Stat(filepath.Join(s.root, ".oldrc"))
+	assert.True(t, os.IsNotExist(err), "Tombstoned file was not removed")
+
+	_, err = os.Stat(filepath.Join(s.root, "bin/netskel"))
+	assert.True(t, os.IsNotExist(err), "Replaced this client with the shell client")
+
+	for _, cmd := range r.commands {
+		assert.False(t, strings.Contains(cmd, "bin/netskel"), "Fetched the shell client")
+	}
+}
+
+func TestSyncUnchanged(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	s.sync()
+	r.commands = nil
+
+	s.sync()
+	assert.Len(t, r.commands, 1, "Fetched files which were already up to date")
+	assert.Contains(t, r.commands[0], "--since=0123456789abcdef")
+}
+
+func TestSyncKeepsLocalChanges(t *testing.T) {
+	s, _ := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	ioutil.WriteFile(filepath.Join(s.root, ".oldrc"), []byte("mine\n"), 0600)
+	s.sync()
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, ".oldrc"))
+	assert.Nil(t, err, "Removed a locally modified file")
+	assert.Equal(t, "mine\n", string(data))
+}
+
+func TestSyncRemovesSymlinksAndDirs(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	s.sync()
+	os.Symlink("mine", filepath.Join(s.root, ".relinked"))
+
+	r.manifest.Revision = "fedcba9876543210"
+	for i := 2; i <= 4; i++ {
+		r.manifest.Entries[i].Type = manifest.TypeTombstone
+	}
+	r.manifest.Entries = append(r.manifest.Entries, manifest.Entry{Path: ".relinked", Type: manifest.TypeTombstone, Mode: 0777, Target: "theirs"})
+	s.sync()
+
+	for _, name := range []string{".vimrc", "Application Support"} {
+		_, err := os.Lstat(filepath.Join(s.root, name))
+		assert.True(t, os.IsNotExist(err), "Tombstoned %s was not removed", name)
+	}
+	target, _ := os.Readlink(filepath.Join(s.root, ".relinked"))
+	assert.Equal(t, "mine", target, "Removed a symlink which was changed locally")
+}
+
+func TestSyncActions(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	r.manifest.Entries[3].Meta = map[string]string{manifest.MetaRun: "echo ran >> actions.log"}
+	s.sync()
+	s.sync()
+
+	data, err := ioutil.ReadFile(filepath.Join(s.root, "actions.log"))
+	assert.Nil(t, err)
+	assert.Equal(t, "ran\n", string(data), "Actions should only run when their file changes")
+}
+
+func TestSyncDryRun(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	ioutil.WriteFile(filepath.Join(s.root, ".oldrc"), []byte("old\n"), 0600)
+	r.manifest.Entries[3].Meta = map[string]string{manifest.MetaRun: "echo ran >> actions.log"}
+	s.dryRun = true
+	s.sync()
+
+	assert.Contains(t, r.commands[0], "--dry-run")
+	assert.Len(t, r.commands, 1, "Fetched files in a dry run")
+
+	for _, name := range []string{"Application Support", ".vimrc", "actions.log", ".netskel/dbfile"} {
+		_, err := os.Lstat(filepath.Join(s.root, name))
+		assert.True(t, os.IsNotExist(err), "Dry run created %s", name)
+	}
+	_, err := os.Stat(filepath.Join(s.root, ".oldrc"))
+	assert.Nil(t, err, "Dry run removed a file")
+
+	r.commands = nil
+	s.diff = true
+	s.sync()
+
+	assert.Len(t, r.commands, 2, "Diff should fetch the one file which would change")
+	_, err = os.Stat(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.True(t, os.IsNotExist(err), "Diff installed a file")
+}
+
+func TestInstallVerifies(t *testing.T) {
+	s, _ := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	filename := filepath.Join(s.root, ".profile")
+	ioutil.WriteFile(filename, []byte("mine\n"), 0600)
+
+	e := fileEntry(".profile", "theirs\n", 0640)
+	assert.NotNil(t, s.install(filename, []byte("truncat"), e), "Installed content which doesn't match the manifest")
+
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data), "Failed install touched the original")
+
+	assert.Nil(t, s.install(filename, []byte("theirs\n"), e))
+	data, _ = ioutil.ReadFile(filename)
+	assert.Equal(t, "theirs\n", string(data))
+	info, _ := os.Stat(filename)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+
+	leftovers, _ := filepath.Glob(filepath.Join(s.root, ".netskel-*"))
+	assert.Empty(t, leftovers, "Temporary files were left behind")
+}
+
+func TestFetchFileVerifies(t *testing.T) {
+	r := &fakeRemote{files: map[string]string{"hello": "Hello, world!\n"}}
+
+	data, err := fetchFile(r, hello(r), "", "hello", "uuid")
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello, world!\n", string(data))
+
+	_, err = fetchFile(r, hello(r), "", "missing", "uuid")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "404")
+
+	truncated := &truncatingRemote{r}
+	_, err = fetchFile(truncated, hello(r), "", "hello", "uuid")
+	assert.NotNil(t, err)
+}
+
+// truncatingRemote drops the trailer, like a connection lost mid-transfer.
+type truncatingRemote struct {
+	*fakeRemote
+}
+
+func (r *truncatingRemote) Run(command string, stdout io.Writer) error {
+	var buf bytes.Buffer
+	err := r.fakeRemote.Run(command, &buf)
+	stdout.Write([]byte(strings.SplitN(buf.String(), TRAILER, 2)[0]))
+	return err
+}
+
+func TestSamePlatform(t *testing.T) {
+	assert.False(t, samePlatform("Plan9 mips"))
+	assert.False(t, samePlatform(""))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// loadUnmanaged reads the paths this host has stopped managing.
+func loadUnmanaged(filename string) map[string]bool {
+	unmanaged := make(map[string]bool)
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return unmanaged
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			unmanaged[line] = true
+		}
+	}
+
+	return unmanaged
+}
+
+// isUnmanaged reports whether name, or a directory above it, is no longer
+// managed on this host.
+func isUnmanaged(unmanaged map[string]bool, name string) bool {
+	for p := path.Clean(name); p != "." && p != "/"; p = path.Dir(p) {
+		if unmanaged[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// managedName turns a path given on the command line, relative to the
+// current directory, into the name the server knows it by.
+func managedName(root, arg string) (string, error) {
+	abs, err := filepath.Abs(arg)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", arg, root)
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// unmanage stops sync from touching the path at arg, or anything beneath
+// it, on this host.  The file itself is left as it is.
+func unmanage(c config, arg string) error {
+	name, err := managedName(c["NETSKEL_ROOT"], arg)
+	if err != nil {
+		return err
+	}
+
+	previous := loadDB(c["NETSKEL_DBFILE"])
+	installed := loadInstalled(c["NETSKEL_INSTALLED"], previous)
+
+	found := false
+	if previous != nil {
+		for _, e := range previous.Entries {
+			if e.Type != manifest.TypeTombstone && (e.Path == name || strings.HasPrefix(e.Path, name+"/")) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not managed by netskel", name)
+	}
+
+	filename := c["NETSKEL_UNMANAGED"]
+	unmanaged := loadUnmanaged(filename)
+	if isUnmanaged(unmanaged, name) {
+		Log("%s is already unmanaged", name)
+		return nil
+	}
+	unmanaged[name] = true
+
+	var names []string
+	for p := range unmanaged {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(names, "\n")+"\n"), 0600); err != nil {
+		return err
+	}
+
+	for p := range installed {
+		if isUnmanaged(unmanaged, p) {
+			delete(installed, p)
+		}
+	}
+	if err := saveInstalled(c["NETSKEL_INSTALLED"], installed); err != nil {
+		return err
+	}
+
+	Log("%s is no longer managed by netskel", name)
+	return nil
+}
+
+// retire tells the server over r that this client is gone.
+func retire(c config, r remote) error {
+	if r == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	caps := hello(r)
+	if !caps.has("commands", "retire") {
+		return fmt.Errorf("the server predates retiring clients")
+	}
+
+	cmd, err := caps.command("retire", nil, clientUUID(c), whoami(), hostname())
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := r.Run(cmd, &out); err != nil {
+		return serverError(out.Bytes(), err)
+	}
+	return nil
+}
+
+// uninstall removes every file and symlink sync installed, putting back
+// what was there before netskel first touched it, and tells the server over
+// r that this client is retired.  Files changed locally since sync
+// installed them are kept.
+func uninstall(c config, r remote) error {
+	previous := loadDB(c["NETSKEL_DBFILE"])
+	installed := loadInstalled(c["NETSKEL_INSTALLED"], previous)
+	unmanaged := loadUnmanaged(c["NETSKEL_UNMANAGED"])
+	originals := &backup{dir: c["NETSKEL_ORIGINALS"]}
+
+	s := &syncer{root: c["NETSKEL_ROOT"]}
+
+	var names []string
+	for name := range installed {
+		names = append(names, name)
+	}
+	if previous != nil {
+		for _, e := range previous.Entries {
+			if e.Type != manifest.TypeSymlink {
+				continue
+			}
+			if fullpath, err := s.localPath(e.Path); err == nil {
+				if target, _ := os.Readlink(fullpath); target == e.Target {
+					names = append(names, e.Path)
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+
+	failed := 0
+	for _, name := range names {
+		if name == CLIENTPATH || isUnmanaged(unmanaged, name) {
+			continue
+		}
+
+		fullpath, err := s.localPath(name)
+		if err != nil {
+			Log("E %s %v", name, err)
+			failed++
+			continue
+		}
+
+		if hash, ok := installed[name]; ok {
+			local, err := fileHash(fullpath)
+			if err != nil {
+				continue
+			}
+			if local != hash {
+				Log("M %s has local changes, keeping it", name)
+				continue
+			}
+		}
+
+		op := originals.lookup(name)
+		if op == "" {
+			op = "C"
+		}
+		if err := originals.restore(s, op, name); err != nil {
+			Log("E %s %v", name, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d entries could not be uninstalled", failed)
+	}
+
+	if err := retire(c, r); err != nil {
+		Log("Unable to tell the server this client is retired: %v", err)
+	}
+
+	os.RemoveAll(c["NETSKEL_ORIGINALS"])
+	for _, key := range []string{"NETSKEL_DBFILE", "NETSKEL_INSTALLED", "NETSKEL_CONFLICTS", "NETSKEL_LASTSYNC", "NETSKEL_UNMANAGED", "NETSKEL_IDENTITY"} {
+		os.Remove(c[key])
+	}
+
+	Log("netskel is uninstalled, backups remain in %s", c["NETSKEL_BACKUPS"])
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnmanage(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+	s.sync()
+
+	filename := filepath.Join(s.root, "Application Support/init.vim")
+	assert.NotNil(t, unmanage(s.cfg, filepath.Join(s.root, ".nothing")))
+	assert.NotNil(t, unmanage(s.cfg, "/etc/passwd"))
+	assert.Nil(t, unmanage(s.cfg, filepath.Join(s.root, "Application Support")))
+	assert.Empty(t, loadInstalled(s.cfg["NETSKEL_INSTALLED"], nil)["Application Support/init.vim"])
+
+	ioutil.WriteFile(filename, []byte("mine\n"), 0640)
+	r.manifest.Revision = "fedcba9876543210"
+	r.manifest.Entries[3] = fileEntry("Application Support/init.vim", "set nocompatible ruler\n", 0640)
+	r.files["Application Support/init.vim"] = "set nocompatible ruler\n"
+	r.conflicts = nil
+	s.sync()
+
+	data, _ := ioutil.ReadFile(filename)
+	assert.Equal(t, "mine\n", string(data), "Sync touched an unmanaged file")
+	_, err := os.Stat(filename + NEWSUFFIX)
+	assert.True(t, os.IsNotExist(err))
+	assert.Empty(t, r.conflicts)
+}
+
+func TestUninstall(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	// Something of the user's own, which sync replaces
+	os.MkdirAll(filepath.Join(s.root, "Application Support"), 0750)
+	ioutil.WriteFile(filepath.Join(s.root, "Application Support/init.vim"), []byte("original\n"), 0640)
+	r.manifest.Entries = append(r.manifest.Entries, fileEntry(".profile", "umask 077\n", 0600))
+	r.files[".profile"] = "umask 077\n"
+	s.sync()
+
+	r.manifest.Revision = "fedcba9876543210"
+	r.manifest.Entries = append(r.manifest.Entries, fileEntry(".inputrc", "set bell-style none\n", 0600))
+	r.files[".inputrc"] = "set bell-style none\n"
+	s.sync()
+	ioutil.WriteFile(filepath.Join(s.root, ".inputrc"), []byte("mine\n"), 0600)
+	ioutil.WriteFile(s.cfg["NETSKEL_IDENTITY"], []byte("# CLIENT_UUID 6ec558e1-5f06-4083-9070-206819b53916\n"), 0400)
+
+	assert.Nil(t, uninstall(s.cfg, r))
+
+	data, _ := ioutil.ReadFile(filepath.Join(s.root, "Application Support/init.vim"))
+	assert.Equal(t, "original\n", string(data), "The user's own file wasn't put back")
+	for _, name := range []string{".profile", ".vimrc"} {
+		_, err := os.Lstat(filepath.Join(s.root, name))
+		assert.True(t, os.IsNotExist(err), "%s was left behind", name)
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(s.root, ".inputrc"))
+	assert.Equal(t, "mine\n", string(data), "Local changes were removed")
+
+	assert.True(t, r.retired, "The server wasn't told")
+	for _, key := range []string{"NETSKEL_DBFILE", "NETSKEL_INSTALLED", "NETSKEL_IDENTITY"} {
+		_, err := os.Stat(s.cfg[key])
+		assert.True(t, os.IsNotExist(err), "%s was left behind", key)
+	}
+}
+
+func TestUninstallIgnoresPrunedBackups(t *testing.T) {
+	s, r := testSyncer(t)
+	defer os.RemoveAll(s.root)
+
+	r.manifest.Entries = append(r.manifest.Entries, fileEntry(".profile", "umask 077\n", 0600))
+	r.files[".profile"] = "umask 077\n"
+	s.sync()
+	assert.Equal(t, "C", (&backup{dir: s.cfg["NETSKEL_ORIGINALS"]}).lookup(".profile"))
+
+	// The oldest backup left after pruning holds a version netskel installed
+	stale := filepath.Join(s.cfg["NETSKEL_BACKUPS"], "20200101-000000")
+	os.MkdirAll(filepath.Join(stale, "files"), 0700)
+	ioutil.WriteFile(filepath.Join(stale, "files/.profile"), []byte("umask 022\n"), 0600)
+	ioutil.WriteFile(filepath.Join(stale, "index"), []byte("U\t.profile\n"), 0600)
+
+	assert.Nil(t, uninstall(s.cfg, r))
+
+	_, err := os.Lstat(filepath.Join(s.root, ".profile"))
+	assert.True(t, os.IsNotExist(err), "A version netskel installed was put back")
+	_, err = os.Stat(s.cfg["NETSKEL_ORIGINALS"])
+	assert.True(t, os.IsNotExist(err), "Originals were kept after uninstalling")
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/nugget/netskel/manifest"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -67,7 +71,9 @@ func clientList() {
 			c := b.Cursor()
 
 			isDisabled := b.Get([]byte("disabled"))
-			if showDisabled && isDisabled != nil {
+			if showDisabled && b.Get([]byte("retired")) != nil {
+				Disableds[uuid] = "R"
+			} else if showDisabled && isDisabled != nil {
 				Disableds[uuid] = "X"
 			} else {
 				Disableds[uuid] = ""
@@ -123,7 +129,7 @@ func transformKey(k, v []byte) []byte {
 	retbuf := v
 
 	switch string(k) {
-	case "created", "lastSeen", "disabled":
+	case "created", "lastSeen", "disabled", "conflictsReported", "retired":
 		epoch, _ := strconv.ParseInt(string(v), 10, 64)
 		retbuf = []byte(time.Unix(epoch, 0).Format("Mon Jan 2 2006 @ 15:04:05 MST"))
 	}
@@ -237,6 +243,409 @@ func clientPut(uuid, key, value string) (err error) {
 	return berr
 }
 
+func clientGet(uuid, key string) (retval string) {
+	db, err := bolt.Open(BASEDIR+"/clients.db", 0660, nil)
+	if err != nil {
+		fmt.Printf("Unable to open client database: %v\n", err)
+		return ""
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(uuid))
+		if b != nil {
+			retval = string(b.Get([]byte(key)))
+		}
+		return nil
+	})
+
+	return retval
+}
+
+func groupPut(group, key, value string) (err error) {
+	db, err := bolt.Open(BASEDIR+"/groups.db", 0660, nil)
+	if err != nil {
+		fmt.Printf("Unable to open group database: %v\n", err)
+		return err
+	}
+	defer db.Close()
+
+	berr := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(group))
+		if err != nil {
+			return err
+		}
+
+		if value != "" {
+			oldVal := string(b.Get([]byte(key)))
+			err = b.Put([]byte(key), []byte(value))
+			Debug("%s %s: %v -> %v", group, key, oldVal, value)
+		} else {
+			err = b.Delete([]byte(key))
+		}
+
+		return err
+	})
+
+	if berr != nil {
+		fmt.Printf("%v\n", berr)
+	}
+
+	return berr
+}
+
+func groupList() {
+	db, err := bolt.Open(BASEDIR+"/groups.db", 0660, nil)
+	if err != nil {
+		fmt.Printf("Unable to open group database: %v\n", err)
+		return
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			fmt.Printf("[%s]\n", name)
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				fmt.Printf("  %-10s: %s\n", k, v)
+			}
+			fmt.Println("")
+			return nil
+		})
+	})
+}
+
+// tagClient adds or removes a group tag on a client.
+func tagClient(uuid, tag string, add bool) error {
+	var tags []string
+
+	for _, t := range strings.Split(clientGet(uuid, "tags"), ",") {
+		if t != "" && t != tag {
+			tags = append(tags, t)
+		}
+	}
+	if add {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+
+	return clientPut(uuid, "tags", strings.Join(tags, ","))
+}
+
+func rolloutGet() map[string]string {
+	values := make(map[string]string)
+
+	db, err := bolt.Open(BASEDIR+"/rollout.db", 0660, nil)
+	if err != nil {
+		fmt.Printf("Unable to open rollout database: %v\n", err)
+		return values
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("rollout"))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			values[string(k)] = string(v)
+			return nil
+		})
+	})
+
+	return values
+}
+
+func rolloutPut(values map[string]string) error {
+	db, err := bolt.Open(BASEDIR+"/rollout.db", 0660, nil)
+	if err != nil {
+		fmt.Printf("Unable to open rollout database: %v\n", err)
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("rollout"))
+		if err != nil {
+			return err
+		}
+
+		for k, v := range values {
+			Debug("rollout %s: %v -> %v", k, string(b.Get([]byte(k))), v)
+			if v == "" {
+				err = b.Delete([]byte(k))
+			} else {
+				err = b.Put([]byte(k), []byte(v))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// gitCommit resolves a ref in the db repository to a commit ID.
+func gitCommit(ref string) (string, error) {
+	out, err := exec.Command("git", "-C", BASEDIR+"/db", "rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		return "", fmt.Errorf("Unknown git ref %s", ref)
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+func rolloutStatus() {
+	r := rolloutGet()
+
+	if r["target"] == "" && r["stable"] != "" {
+		fmt.Printf("No rollout in progress, fleet is held on %s\n", r["stable"])
+		return
+	}
+	if r["target"] == "" {
+		fmt.Printf("No rollout in progress, last rollout deployed %s\n", r["deployed"])
+		return
+	}
+
+	stage := r["stage"]
+	if stage == "percent" {
+		stage = r["percent"] + "% of fleet"
+	}
+	if r["paused"] != "" {
+		stage += " (paused)"
+	}
+
+	fmt.Printf("Rolling out %s\n", r["target"])
+	fmt.Printf("  from %s\n", r["stable"])
+	fmt.Printf("  stage: %s\n", stage)
+}
+
+// rolloutCommand drives the staged rollout of a new db revision: canary
+// hosts first, then a growing percentage of the fleet, then everyone.
+func rolloutCommand(action string) error {
+	r := rolloutGet()
+	now := strconv.Itoa(int(time.Now().Unix()))
+
+	if action != "start" && action != "status" && r["target"] == "" {
+		return fmt.Errorf("No rollout in progress")
+	}
+
+	switch action {
+	case "start":
+		if r["target"] != "" {
+			return fmt.Errorf("Rollout of %s already in progress", r["target"])
+		}
+
+		target, err := gitCommit(getArg(2, "HEAD"))
+		if err != nil {
+			return err
+		}
+
+		stable := r["stable"]
+		if stable == "" {
+			stable = r["deployed"]
+		}
+		if ref := getArg(3, ""); ref != "" {
+			if stable, err = gitCommit(ref); err != nil {
+				return err
+			}
+		}
+		if stable == "" {
+			return fmt.Errorf("First rollout needs the currently deployed ref: rollout start <ref> <stable-ref>")
+		}
+
+		err = rolloutPut(map[string]string{"stable": stable, "target": target, "stage": "canary", "percent": "", "paused": "", "updated": now})
+		if err != nil {
+			return err
+		}
+
+	case "advance":
+		percent := getArgInt(2, 0)
+		current, _ := strconv.Atoi(r["percent"])
+		if percent == 0 {
+			switch {
+			case r["stage"] == "canary":
+				percent = 10
+			case current < 50:
+				percent = 50
+			default:
+				percent = 100
+			}
+		}
+
+		if percent >= 100 {
+			// The fleet goes back to following its refs
+			err := rolloutPut(map[string]string{"stable": "", "deployed": r["target"], "target": "", "stage": "", "percent": "", "paused": "", "updated": now})
+			if err == nil {
+				fmt.Printf("Rollout complete, deployed %s\n", r["target"])
+			}
+			return err
+		}
+
+		err := rolloutPut(map[string]string{"stage": "percent", "percent": strconv.Itoa(percent), "updated": now})
+		if err != nil {
+			return err
+		}
+
+	case "pause":
+		if err := rolloutPut(map[string]string{"paused": now, "updated": now}); err != nil {
+			return err
+		}
+
+	case "resume":
+		if err := rolloutPut(map[string]string{"paused": "", "updated": now}); err != nil {
+			return err
+		}
+
+	case "rollback":
+		err := rolloutPut(map[string]string{"target": "", "stage": "", "percent": "", "paused": "", "updated": now})
+		if err == nil {
+			fmt.Printf("Rolled back %s, fleet is on %s\n", r["target"], r["stable"])
+		}
+		return err
+
+	case "status":
+
+	default:
+		Usage()
+	}
+
+	rolloutStatus()
+	return nil
+}
+
+// pinClient holds a client at one revision: either a snapshot the server has
+// sent before, kept as pin, or a git ref, which is resolved to a fixed
+// commit and kept as pinRef.  The rev "previous" means whatever the client
+// received before its current revision.
+func pinClient(uuid, rev string) error {
+	if rev == "previous" {
+		rev = clientGet(uuid, "previousRevision")
+		if rev == "" {
+			return fmt.Errorf("No previous revision recorded for %s", uuid)
+		}
+	}
+
+	key, other := "pin", "pinRef"
+	if _, err := os.Stat(BASEDIR + "/snapshots/" + rev + ".json"); err != nil {
+		commit, err := gitCommit(rev)
+		if err != nil {
+			return fmt.Errorf("%s is neither a snapshot nor a git ref", rev)
+		}
+		rev = commit
+		key, other = other, key
+	}
+
+	if err := clientPut(uuid, other, ""); err != nil {
+		return err
+	}
+	if err := clientPut(uuid, key, rev); err != nil {
+		return err
+	}
+
+	fmt.Printf("Pinned %s to %s\n", uuid, rev)
+	return nil
+}
+
+// freezeClient pins a client to the revision it last received.
+func freezeClient(uuid string) error {
+	rev := clientGet(uuid, "revision")
+	if rev == "" {
+		return fmt.Errorf("No revision recorded for %s", uuid)
+	}
+
+	return pinClient(uuid, rev)
+}
+
+// clientRemovals lists the files a client has been told to remove, from the
+// snapshot it was sent most recently.
+func clientRemovals(uuid string) error {
+	revision := clientGet(uuid, "revision")
+	if revision == "" {
+		return fmt.Errorf("No revision recorded for %s", uuid)
+	}
+
+	f, err := os.Open(BASEDIR + "/snapshots/" + revision + ".json")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	m, err := manifest.Parse(f)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pending removals for %s:\n\n", uuid)
+	for _, e := range m.Entries {
+		if e.Type == manifest.TypeTombstone {
+			removed := transformKey([]byte("created"), []byte(strconv.FormatInt(e.MTime, 10)))
+			fmt.Printf("  %-40s removed %s\n", e.Path, removed)
+		}
+	}
+
+	return nil
+}
+
+// clientConflicts lists the locally changed files which hosts are holding
+// back from sync, for one host or for every host which has any.
+func clientConflicts(search string) error {
+	db, err := bolt.Open(BASEDIR+"/clients.db", 0660, nil)
+	if err != nil {
+		return fmt.Errorf("Unable to open client database: %v", err)
+	}
+	defer db.Close()
+
+	found := false
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if search != "" && string(name) != search {
+				return nil
+			}
+
+			stored, _ := url.ParseQuery(string(b.Get([]byte("conflicts"))))
+			paths := stored["path"]
+			if len(paths) == 0 {
+				return nil
+			}
+			found = true
+
+			reported := transformKey([]byte("conflictsReported"), b.Get([]byte("conflictsReported")))
+			fmt.Printf("[%s] %s, reported %s\n", name, b.Get([]byte("hostname")), reported)
+			for _, path := range paths {
+				fmt.Printf("  %s\n", path)
+			}
+			fmt.Println("")
+
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		fmt.Println("No locally changed files reported")
+	}
+	return nil
+}
+
+// parseInterval normalizes a sync interval given as seconds or a duration
+// such as "90m" to seconds.  An empty interval clears the setting.
+func parseInterval(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	secs, err := manifest.ParseInterval(value)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(secs, 10), nil
+}
+
 func disableClient(uuid string) error {
 	now := time.Now()
 	secs := strconv.Itoa(int(now.Unix()))
@@ -309,6 +718,27 @@ func Usage() {
 	fmt.Println("  disable <uuid>     Disable single host")
 	fmt.Println("  enable <uuid>      Disable single host")
 	fmt.Println("  delete <uuid>      Delete single host")
+	fmt.Println("  tag <uuid> <group> Add host to group")
+	fmt.Println("  untag <uuid> <grp> Remove host from group")
+	fmt.Println("  ref <uuid> [ref]   Serve host from git ref (or clear)")
+	fmt.Println("  groupref <g> [ref] Serve group from git ref (or clear)")
+	fmt.Println("  groups             Show settings for all groups")
+	fmt.Println("  interval <uuid> [interval]")
+	fmt.Println("                     Suggest host syncs this often (or clear)")
+	fmt.Println("  groupinterval <g> [interval]")
+	fmt.Println("                     Suggest group syncs this often (or clear)")
+	fmt.Println("  freeze <uuid>      Pin host to the revision it last received")
+	fmt.Println("  pin <uuid> <rev>   Pin host to a snapshot, git ref or 'previous'")
+	fmt.Println("  unpin <uuid>       Let host follow the fleet again")
+	fmt.Println("  removals <uuid>    Show files host has been told to remove")
+	fmt.Println("  conflicts [uuid]   Show locally changed files hosts kept from sync")
+	fmt.Println("  rollout status     Show the staged rollout in progress")
+	fmt.Println("  rollout start <ref> [stable-ref]")
+	fmt.Println("                     Roll out git ref, canary hosts first")
+	fmt.Println("  rollout advance [percent]")
+	fmt.Println("                     Widen the rollout to more of the fleet")
+	fmt.Println("  rollout pause|resume|rollback")
+	fmt.Println("                     Hold, continue or abandon the rollout")
 	fmt.Println("  audit <days>       Show hosts not seen in <days> days")
 	os.Exit(1)
 }
@@ -341,6 +771,65 @@ func main() {
 		enableClient(getArg(1, "netskelnotfound"))
 	case "delete":
 		deleteClient(getArg(1, "netskelnotfound"))
+	case "tag":
+		tagClient(getArg(1, "netskelnotfound"), getArg(2, "netskelnotfound"), true)
+	case "untag":
+		tagClient(getArg(1, "netskelnotfound"), getArg(2, "netskelnotfound"), false)
+	case "ref", "groupref":
+		// The ref itself is stored so a branch keeps being followed
+		ref := getArg(2, "")
+		if ref != "" {
+			if _, err := gitCommit(ref); err != nil {
+				fmt.Printf("%v\n", err)
+				os.Exit(1)
+			}
+		}
+		if command == "ref" {
+			clientPut(getArg(1, "netskelnotfound"), "ref", ref)
+		} else {
+			groupPut(getArg(1, "netskelnotfound"), "ref", ref)
+		}
+	case "groups":
+		groupList()
+	case "interval", "groupinterval":
+		interval, err := parseInterval(getArg(2, ""))
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		if command == "interval" {
+			clientPut(getArg(1, "netskelnotfound"), "interval", interval)
+		} else {
+			groupPut(getArg(1, "netskelnotfound"), "interval", interval)
+		}
+	case "freeze":
+		if err := freezeClient(getArg(1, "netskelnotfound")); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	case "pin":
+		if err := pinClient(getArg(1, "netskelnotfound"), getArg(2, "previous")); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	case "unpin":
+		clientPut(getArg(1, "netskelnotfound"), "pin", "")
+		clientPut(getArg(1, "netskelnotfound"), "pinRef", "")
+	case "removals":
+		if err := clientRemovals(getArg(1, "netskelnotfound")); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	case "conflicts":
+		if err := clientConflicts(getArg(1, "")); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+	case "rollout":
+		if err := rolloutCommand(getArg(1, "status")); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	os.Exit(0)
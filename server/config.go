@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// CONFIGFILE is the optional server configuration file.  Each line holds a
+// "key = value" setting and anything following a '#' is a comment.
+var CONFIGFILE = "netskel.conf"
+
+// config holds the settings read from CONFIGFILE.
+var config = map[string]string{}
+
+// loadConfig reads CONFIGFILE into config.  A missing file leaves the
+// defaults in place.
+func loadConfig() error {
+	f, err := os.Open(CONFIGFILE)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		config[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+
+	return scanner.Err()
+}
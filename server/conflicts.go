@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// RecordConflicts stores the paths a client is holding back from sync because
+// they were changed locally, as listed by its --path options.  Each report
+// replaces the last, so an empty one clears the client's conflicts.
+func (s *session) RecordConflicts() error {
+	paths := s.Options["path"]
+
+	value := ""
+	if len(paths) > 0 {
+		value = url.Values{"path": paths}.Encode()
+	}
+
+	if err := clientPut(s.UUID, "conflicts", value); err != nil {
+		return err
+	}
+	if err := clientPut(s.UUID, "conflictsReported", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return err
+	}
+
+	if len(paths) > 0 {
+		Log("%s@%s has %d locally changed files (%s)", s.Username, s.Hostname, len(paths), s.UUID)
+	} else {
+		Debug("%s@%s has no locally changed files (%s)", s.Username, s.Hostname, s.UUID)
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecordConflicts(t *testing.T) {
+	s := newSession()
+	s.UUID = "2f6a8c3e-9d1b-4e7a-b5c0-7e3d9a1f4b62"
+	s.Options = url.Values{"path": {".bashrc", "Application Support/init.vim"}}
+
+	assert.Nil(t, s.RecordConflicts())
+	stored, _ := url.ParseQuery(clientGet(s.UUID, "conflicts"))
+	assert.Equal(t, []string{".bashrc", "Application Support/init.vim"}, stored["path"])
+	assert.NotEmpty(t, clientGet(s.UUID, "conflictsReported"))
+
+	s.Options = nil
+	assert.Nil(t, s.RecordConflicts())
+	assert.Empty(t, clientGet(s.UUID, "conflicts"), "Resolved conflicts were kept")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/nugget/netskel/manifest"
+)
+
+// HASHCACHE is the filename of the fingerprint cache database.
+var HASHCACHE = "fingerprints.db"
+
+// hashBucket is the bolt bucket holding cached fingerprints, keyed by path.
+var hashBucket = []byte("fingerprints")
+
+// fileStamp summarizes the attributes which change whenever a file's
+// contents do, so a cached fingerprint can be trusted while they match.
+func fileStamp(info os.FileInfo) string {
+	var inode uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		inode = uint64(st.Ino)
+	}
+
+	return fmt.Sprintf("%d %d %d", info.Size(), info.ModTime().UnixNano(), inode)
+}
+
+// fingerprintEntries fills in the Hash of every file entry, whose paths are
+// relative to root.  Fingerprints of unchanged files come from the cache and
+// the rest are computed in parallel and cached for the next session.
+func fingerprintEntries(root string, entries []manifest.Entry) {
+	var misses []int
+
+	filenames := make(map[int]string)
+	stamps := make(map[int]string)
+
+	for i, e := range entries {
+		if e.Type != manifest.TypeFile {
+			continue
+		}
+
+		filename := filepath.Join(root, e.Path)
+		info, err := os.Stat(filename)
+		if err != nil {
+			Warn("Error Stat %v: %v", filename, err)
+			continue
+		}
+
+		filenames[i] = filename
+		stamps[i] = fileStamp(info)
+	}
+
+	cached := cacheLookup(filenames)
+	for i, filename := range filenames {
+		value := cached[filename]
+		if strings.HasPrefix(value, stamps[i]+" ") {
+			entries[i].Hash = strings.TrimPrefix(value, stamps[i]+" ")
+		} else {
+			misses = append(misses, i)
+		}
+	}
+
+	if len(misses) == 0 {
+		return
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				hash, err := fingerprint(filenames[i])
+				if err != nil {
+					Warn("Unable to determine fingerprint for %s: %v", filenames[i], err)
+					continue
+				}
+				entries[i].Hash = fmt.Sprintf("%x", hash)
+			}
+		}()
+	}
+	for _, i := range misses {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	updates := make(map[string]string)
+	for _, i := range misses {
+		if entries[i].Hash != "" {
+			updates[filenames[i]] = stamps[i] + " " + entries[i].Hash
+		}
+	}
+	cacheStore(updates)
+
+	Debug("Fingerprinted %d of %d files in %s", len(misses), len(filenames), root)
+}
+
+// cacheLookup returns the cached values for the given filenames.  A missing
+// or busy cache simply yields no hits.
+func cacheLookup(filenames map[int]string) map[string]string {
+	values := make(map[string]string)
+
+	if _, err := os.Stat(HASHCACHE); err != nil {
+		return values
+	}
+
+	db, err := bolt.Open(HASHCACHE, 0660, &bolt.Options{ReadOnly: true, Timeout: 2 * time.Second})
+	if err != nil {
+		Warn("Unable to open fingerprint cache: %v", err)
+		return values
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(hashBucket)
+		if b == nil {
+			return nil
+		}
+		for _, filename := range filenames {
+			if v := b.Get([]byte(filename)); v != nil {
+				values[filename] = string(v)
+			}
+		}
+		return nil
+	})
+
+	return values
+}
+
+// cacheStore saves freshly computed fingerprints to the cache.
+func cacheStore(values map[string]string) error {
+	db, err := bolt.Open(HASHCACHE, 0660, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		Warn("Unable to open fingerprint cache: %v", err)
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(hashBucket)
+		if err != nil {
+			return err
+		}
+		for filename, value := range values {
+			if err := b.Put([]byte(filename), []byte(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFingerprintEntries(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ioutil.WriteFile(filepath.Join(root, "hello"), []byte("Hello, world!\n"), 0644)
+	os.Mkdir(filepath.Join(root, "empty"), 0755)
+
+	entries, err := collectDir(root, "")
+	assert.Nil(t, err)
+	fingerprintEntries(root, entries)
+
+	hashes := make(map[string]string)
+	for _, e := range entries {
+		hashes[e.Path] = e.Hash
+	}
+	assert.Equal(t, "746308829575e17c3331bbcb00c0898b", hashes["hello"])
+	assert.Equal(t, "", hashes["empty"], "Directories have no fingerprint")
+
+	cached := cacheLookup(map[int]string{0: filepath.Join(root, "hello")})
+	assert.Contains(t, cached[filepath.Join(root, "hello")], "746308829575e17c3331bbcb00c0898b")
+}
+
+func TestFingerprintCacheReuse(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	filename := filepath.Join(root, "hello")
+	ioutil.WriteFile(filename, []byte("Hello, world!\n"), 0644)
+	info, _ := os.Stat(filename)
+
+	// A cached fingerprint is trusted while the file stamp still matches
+	cacheStore(map[string]string{filename: fileStamp(info) + " cafef00d"})
+	entries := []manifest.Entry{{Path: "hello", Type: manifest.TypeFile}}
+	fingerprintEntries(root, entries)
+	assert.Equal(t, "cafef00d", entries[0].Hash, "Cached fingerprint was not used")
+
+	// and discarded as soon as the file changes
+	ioutil.WriteFile(filename, []byte("Goodbye, world!\n"), 0644)
+	os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute))
+	entries[0].Hash = ""
+	fingerprintEntries(root, entries)
+	assert.Equal(t, "90cef9cada92ce2cf05cbde9499afbdb", entries[0].Hash)
+}
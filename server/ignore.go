@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// IGNOREFILE lists paths which are never sent to clients, in gitignore
+// syntax.  One may appear in any directory of the db and its patterns are
+// relative to that directory.
+const IGNOREFILE = ".netskelignore"
+
+// An ignoreRule is a single gitignore pattern.
+type ignoreRule struct {
+	base    string // directory holding the rule, relative to the db
+	pattern string
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnore reads the rules of an ignore file found in directory base.
+func parseIgnore(base string, data []byte) []ignoreRule {
+	var rules []ignoreRule
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if r, ok := parseIgnoreLine(base, scanner.Text()); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules
+}
+
+// parseIgnoreLine turns one line of gitignore syntax into a rule.  Blank
+// lines and comments yield nothing.
+func parseIgnoreLine(base, line string) (ignoreRule, bool) {
+	r := ignoreRule{base: base}
+
+	line = strings.TrimRight(line, " \t\r")
+	switch {
+	case line == "" || strings.HasPrefix(line, "#"):
+		return r, false
+	case strings.HasPrefix(line, "!"):
+		r.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimSuffix(line, "/")
+	}
+
+	// A pattern without a slash matches at any depth below base
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+	r.pattern = strings.TrimPrefix(line, "/")
+
+	return r, r.pattern != ""
+}
+
+// matches reports whether the rule applies to the entry at name.
+func (r ignoreRule) matches(name string, dir bool) bool {
+	if r.dirOnly && !dir {
+		return false
+	}
+
+	if r.base != "" {
+		if !strings.HasPrefix(name, r.base+"/") {
+			return false
+		}
+		name = strings.TrimPrefix(name, r.base+"/")
+	}
+
+	return globMatch(strings.Split(r.pattern, "/"), strings.Split(name, "/"))
+}
+
+// globMatch matches path segments against pattern segments, where a "**"
+// segment stands for any number of directories.
+func globMatch(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if globMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if matched, _ := path.Match(pattern[0], name[0]); !matched {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// globalIgnores returns the rules from the exclude server setting, a
+// whitespace separated list of patterns relative to the db.
+func globalIgnores() []ignoreRule {
+	var rules []ignoreRule
+
+	for _, pattern := range strings.Fields(config["exclude"]) {
+		if r, ok := parseIgnoreLine("", pattern); ok {
+			rules = append(rules, r)
+		}
+	}
+
+	return rules
+}
+
+// ignoreEntries drops the entries of t which are excluded by the exclude
+// setting or an ignore file, along with the ignore files themselves.
+// Entries are listed parents first, and nothing beneath an ignored
+// directory is ever sent, as with git.
+func ignoreEntries(t tree, entries []manifest.Entry) []manifest.Entry {
+	var files []string
+	for _, e := range entries {
+		if e.Type == manifest.TypeFile && path.Base(e.Path) == IGNOREFILE {
+			files = append(files, e.Path)
+		}
+	}
+
+	// Deeper ignore files override shallower ones
+	sort.Slice(files, func(i, j int) bool {
+		return strings.Count(files[i], "/") < strings.Count(files[j], "/")
+	})
+
+	rules := globalIgnores()
+	for _, name := range files {
+		data, err := t.ReadFile(name)
+		if err != nil {
+			Warn("Unable to read %s: %v", name, err)
+			continue
+		}
+
+		base := path.Dir(name)
+		if base == "." {
+			base = ""
+		}
+		rules = append(rules, parseIgnore(base, data)...)
+	}
+
+	var kept []manifest.Entry
+	ignoredDirs := make(map[string]bool)
+
+	for _, e := range entries {
+		if path.Base(e.Path) == IGNOREFILE || ignoredDirs[path.Dir(e.Path)] {
+			if e.Type == manifest.TypeDir {
+				ignoredDirs[e.Path] = true
+			}
+			continue
+		}
+
+		ignored := false
+		for _, r := range rules {
+			if r.matches(e.Path, e.Type == manifest.TypeDir) {
+				ignored = !r.negate
+			}
+		}
+
+		if ignored {
+			if e.Type == manifest.TypeDir {
+				ignoredDirs[e.Path] = true
+			}
+			continue
+		}
+
+		kept = append(kept, e)
+	}
+
+	return kept
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoreRuleMatches(t *testing.T) {
+	for _, tc := range []struct {
+		base, line, name string
+		dir, want        bool
+	}{
+		{"", "*.swp", ".vimrc.swp", false, true},
+		{"", "*.swp", "deep/down/.x.swp", false, true},
+		{"", "README.md", "README.md", false, true},
+		{"", "/README.md", "docs/README.md", false, false},
+		{"", "docs/*.md", "docs/intro.md", false, true},
+		{"", "docs/*.md", "docs/more/intro.md", false, false},
+		{"", "docs/**/*.md", "docs/more/intro.md", false, true},
+		{"", ".github/", ".github", true, true},
+		{"", ".github/", ".github", false, false},
+		{"config", "*.local", "config/nvim/init.local", false, true},
+		{"config", "*.local", "other/init.local", false, false},
+		{"config", "/nvim", "config/nvim", true, true},
+	} {
+		r, ok := parseIgnoreLine(tc.base, tc.line)
+		assert.True(t, ok, tc.line)
+		assert.Equal(t, tc.want, r.matches(tc.name, tc.dir), "%q in %q against %q", tc.line, tc.base, tc.name)
+	}
+
+	_, ok := parseIgnoreLine("", "# comment")
+	assert.False(t, ok)
+	_, ok = parseIgnoreLine("", "   ")
+	assert.False(t, ok)
+
+	r, _ := parseIgnoreLine("", `\#hash`)
+	assert.True(t, r.matches("#hash", false))
+}
+
+func TestIgnoreEntries(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, ".github/workflows"), 0755)
+	os.MkdirAll(filepath.Join(root, "config/nvim"), 0755)
+	for name, content := range map[string]string{
+		IGNOREFILE:                   "README.md\n.github/\n*.local\n",
+		"README.md":                  "Dotfiles\n",
+		".bashrc":                    "umask 077\n",
+		".github/workflows/ci.yml":   "on: push\n",
+		"config/" + IGNOREFILE:       "!keep.local\n",
+		"config/keep.local":          "kept\n",
+		"config/drop.local":          "dropped\n",
+		"config/nvim/init.vim":       "set nocompatible\n",
+		"config/nvim/.init.vim.swp":  "swap\n",
+		"config/nvim/plugin.tmp.bak": "backup\n",
+	} {
+		ioutil.WriteFile(filepath.Join(root, name), []byte(content), 0644)
+	}
+
+	config["exclude"] = "*.swp *.bak"
+	defer delete(config, "exclude")
+
+	entries, err := dirTree{root}.Entries()
+	assert.Nil(t, err)
+
+	var paths []string
+	for _, e := range entries {
+		paths = append(paths, e.Path)
+	}
+	assert.ElementsMatch(t, []string{".bashrc", "config", "config/keep.local", "config/nvim", "config/nvim/init.vim"}, paths)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// METAFILE is the optional sidecar in the root of the db which sets
+// metadata git can't carry.  Each line holds a path or glob pattern, a key
+// and a value, such as "bin/* mode 0755" or ".tmux.conf run tmux
+// source-file ~/.tmux.conf".  Later lines win, and lines starting with a
+// '#' are comments.
+const METAFILE = ".netskelmeta"
+
+// A metaRule sets one key on every entry matching its pattern.
+type metaRule struct {
+	pattern string
+	key     string
+	value   string
+}
+
+// modeMask limits the permission bits sent to clients, set in octal by the
+// mode_mask server setting.  The default keeps everything private to the
+// owner, as netskel always has.
+func modeMask() uint32 {
+	mask, err := strconv.ParseUint(config["mode_mask"], 8, 32)
+	if err != nil {
+		return 0700
+	}
+
+	return uint32(mask) & 0777
+}
+
+// loadMeta reads the sidecar rules from t.  A missing sidecar has no rules.
+func loadMeta(t tree) ([]metaRule, error) {
+	var rules []metaRule
+
+	data, err := t.ReadFile(METAFILE)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			Warn("%s line %d: expected a path, key and value", METAFILE, lineno)
+			continue
+		}
+
+		rest := strings.TrimSpace(strings.TrimPrefix(line, fields[0]))
+		value := strings.TrimSpace(strings.TrimPrefix(rest, fields[1]))
+		rules = append(rules, metaRule{pattern: fields[0], key: fields[1], value: value})
+	}
+
+	return rules, scanner.Err()
+}
+
+// applyMeta applies the sidecar rules of t to its entries, leaving the
+// sidecar itself out of what clients receive.
+func applyMeta(t tree, entries []manifest.Entry) ([]manifest.Entry, error) {
+	rules, err := loadMeta(t)
+	if err != nil {
+		return entries, err
+	}
+
+	var kept []manifest.Entry
+	for _, e := range entries {
+		if e.Path == METAFILE {
+			continue
+		}
+
+		for _, r := range rules {
+			if matched, _ := path.Match(r.pattern, e.Path); !matched {
+				continue
+			}
+			e = r.apply(e)
+		}
+
+		kept = append(kept, e)
+	}
+
+	return kept, nil
+}
+
+// apply sets the rule's key on e.
+func (r metaRule) apply(e manifest.Entry) manifest.Entry {
+	switch r.key {
+	case "mode":
+		if e.Type != manifest.TypeFile && e.Type != manifest.TypeDir {
+			return e
+		}
+		mode, err := strconv.ParseUint(r.value, 8, 32)
+		if err != nil {
+			Warn("%s: bad mode %q for %s", METAFILE, r.value, r.pattern)
+			return e
+		}
+		e.Mode = uint32(mode) & modeMask()
+	case manifest.MetaRun:
+		if e.Type != manifest.TypeFile {
+			return e
+		}
+		meta := map[string]string{manifest.MetaRun: strings.Replace(r.value, "\t", " ", -1)}
+		for k, v := range e.Meta {
+			if k != manifest.MetaRun {
+				meta[k] = v
+			}
+		}
+		e.Meta = meta
+	default:
+		Warn("%s: unknown key %q for %s", METAFILE, r.key, r.pattern)
+	}
+
+	return e
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModeMask(t *testing.T) {
+	assert.Equal(t, uint32(0700), modeMask())
+
+	config["mode_mask"] = "0755"
+	defer delete(config, "mode_mask")
+	assert.Equal(t, uint32(0755), modeMask())
+
+	config["mode_mask"] = "nonsense"
+	assert.Equal(t, uint32(0700), modeMask())
+}
+
+func TestCollectDirModes(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	os.Mkdir(filepath.Join(root, "private"), 0750)
+	ioutil.WriteFile(filepath.Join(root, "readonly"), []byte("Hello, world!\n"), 0444)
+	os.Chmod(filepath.Join(root, "readonly"), 0444)
+
+	config["mode_mask"] = "0777"
+	defer delete(config, "mode_mask")
+
+	entries, err := collectDir(root, "")
+	assert.Nil(t, err)
+
+	byPath := make(map[string]manifest.Entry)
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	assert.Equal(t, uint32(0750), byPath["private"].Mode)
+	assert.Equal(t, uint32(0444), byPath["readonly"].Mode)
+	assert.NotZero(t, byPath["readonly"].MTime)
+}
+
+func TestApplyMeta(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ioutil.WriteFile(filepath.Join(root, METAFILE), []byte(`# Sidecar metadata
+bin/*       mode 0755
+bin/secret  mode 0600
+.ssh        mode 0700
+.tmux.conf  run tmux source-file ~/.tmux.conf
+.ssh        run echo directories have no actions
+nonsense
+`), 0644)
+
+	config["mode_mask"] = "0755"
+	defer delete(config, "mode_mask")
+
+	entries := []manifest.Entry{
+		{Path: METAFILE, Type: manifest.TypeFile, Mode: 0600},
+		{Path: ".ssh", Type: manifest.TypeDir, Mode: 0755},
+		{Path: "bin/script", Type: manifest.TypeFile, Mode: 0600},
+		{Path: "bin/secret", Type: manifest.TypeFile, Mode: 0600},
+		{Path: "hello", Type: manifest.TypeFile, Mode: 0644},
+		{Path: ".tmux.conf", Type: manifest.TypeFile, Mode: 0600},
+	}
+
+	entries, err = applyMeta(dirTree{root}, entries)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 5, "The sidecar itself was served")
+
+	modes := make(map[string]uint32)
+	actions := make(map[string]string)
+	for _, e := range entries {
+		modes[e.Path] = e.Mode
+		actions[e.Path] = e.Meta[manifest.MetaRun]
+	}
+	assert.Equal(t, "tmux source-file ~/.tmux.conf", actions[".tmux.conf"])
+	assert.Equal(t, "", actions[".ssh"])
+	assert.Equal(t, uint32(0700), modes[".ssh"])
+	assert.Equal(t, uint32(0755), modes["bin/script"])
+	assert.Equal(t, uint32(0600), modes["bin/secret"], "Later rules should win")
+	assert.Equal(t, uint32(0644), modes["hello"])
+}
+
+func TestApplyMetaMissing(t *testing.T) {
+	entries := []manifest.Entry{{Path: "hello", Type: manifest.TypeFile, Mode: 0600}}
+
+	out, err := applyMeta(dirTree{"/this/directory/does/not/exist"}, entries)
+	assert.Nil(t, err)
+	assert.Equal(t, entries, out)
+}
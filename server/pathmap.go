@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// MAPFILE is the optional file in the root of the db which delivers db
+// paths somewhere else on the client.  Each line holds a db path, the path
+// to deliver it to and any number of key=value conditions on the client's
+// facts, such as:
+//
+//	config/nvim  .config/nvim
+//	config/nvim  "Library/Application Support/nvim"  os=Darwin
+//	config/git   ${xdg_config_home}/git
+//
+// Fields containing whitespace are double quoted.  A target may refer to a
+// fact as ${name} and the rule is skipped for clients without it.  The
+// longest matching db path wins, and later lines win over earlier ones.
+const MAPFILE = ".netskelmap"
+
+// A mapRule delivers everything beneath source to target.
+type mapRule struct {
+	source string
+	target string
+	when   map[string]string
+}
+
+// pathMap holds the rules which apply to one client, with facts already
+// substituted into their targets.
+type pathMap []mapRule
+
+// splitQuoted splits line on whitespace, keeping double quoted fields whole.
+func splitQuoted(line string) ([]string, error) {
+	var fields []string
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			fields = append(fields, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		end := 1
+		for end < len(line) && line[end] != '"' {
+			if line[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(line) {
+			return fields, fmt.Errorf("Unterminated quote in %q", line)
+		}
+
+		field, err := strconv.Unquote(line[:end+1])
+		if err != nil {
+			return fields, err
+		}
+		fields = append(fields, field)
+		line = line[end+1:]
+	}
+
+	return fields, nil
+}
+
+// loadMap reads the mapping rules from t.  A missing file has no rules.
+func loadMap(t tree) ([]mapRule, error) {
+	var rules []mapRule
+
+	data, err := t.ReadFile(MAPFILE)
+	if os.IsNotExist(err) {
+		return rules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	lineno := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		lineno++
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields, err := splitQuoted(line)
+		if err != nil || len(fields) < 2 {
+			Warn("%s line %d: expected a db path and a target", MAPFILE, lineno)
+			continue
+		}
+
+		r := mapRule{source: path.Clean(fields[0]), target: fields[1], when: make(map[string]string)}
+		for _, condition := range fields[2:] {
+			kv := strings.SplitN(condition, "=", 2)
+			if len(kv) != 2 {
+				Warn("%s line %d: bad condition %q", MAPFILE, lineno, condition)
+				continue
+			}
+			r.when[strings.ToLower(kv[0])] = kv[1]
+		}
+		rules = append(rules, r)
+	}
+
+	return rules, scanner.Err()
+}
+
+// facts describes the client for path mapping.  Facts sent with
+// --fact=key=value are remembered, so fetches which don't repeat them map
+// paths the same way.
+func (s *session) facts() map[string]string {
+	facts := make(map[string]string)
+
+	stored, _ := url.ParseQuery(clientGet(s.UUID, "facts"))
+	for key := range stored {
+		facts[key] = stored.Get(key)
+	}
+	if uname := clientGet(s.UUID, "uname"); uname != "" && facts["os"] == "" {
+		facts["os"] = uname
+	}
+
+	for _, fact := range s.Options["fact"] {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) == 2 {
+			facts[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+
+	facts["hostname"] = s.Hostname
+	facts["username"] = s.Username
+
+	return facts
+}
+
+// recordFacts remembers the facts a client sent with this command.
+func (s *session) recordFacts() {
+	if len(s.Options["fact"]) == 0 || s.UUID == "" {
+		return
+	}
+
+	facts := url.Values{}
+	for _, fact := range s.Options["fact"] {
+		kv := strings.SplitN(fact, "=", 2)
+		if len(kv) == 2 {
+			facts.Set(strings.ToLower(kv[0]), kv[1])
+		}
+	}
+
+	clientPut(s.UUID, "facts", facts.Encode())
+}
+
+// pathMap picks the mapping rules of t which apply to this client.
+func (s *session) pathMap(t tree) (pathMap, error) {
+	var m pathMap
+
+	rules, err := loadMap(t)
+	if err != nil {
+		return m, err
+	}
+
+	facts := s.facts()
+
+rules:
+	for _, r := range rules {
+		for key, pattern := range r.when {
+			if matched, _ := path.Match(pattern, facts[key]); !matched {
+				continue rules
+			}
+		}
+
+		missing := false
+		target := os.Expand(r.target, func(key string) string {
+			value, ok := facts[strings.ToLower(key)]
+			if !ok || value == "" {
+				missing = true
+			}
+			return value
+		})
+		if missing {
+			continue
+		}
+
+		target = path.Clean(target)
+		if path.IsAbs(target) || target == "." || target == ".." || strings.HasPrefix(target, "../") {
+			Warn("%s: refusing to deliver %s outside the client root at %s", MAPFILE, r.source, target)
+			continue
+		}
+
+		m = append(m, mapRule{source: r.source, target: target})
+	}
+
+	return m, nil
+}
+
+// under reports whether name is prefix or beneath it, returning the rest of
+// name following prefix.
+func under(name, prefix string) (string, bool) {
+	if name == prefix {
+		return "", true
+	}
+	if strings.HasPrefix(name, prefix+"/") {
+		return name[len(prefix):], true
+	}
+	return "", false
+}
+
+// target returns where the db path name is delivered.
+func (m pathMap) target(name string) string {
+	best := -1
+	for i, r := range m {
+		if _, ok := under(name, r.source); ok && (best < 0 || len(r.source) >= len(m[best].source)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return name
+	}
+
+	rest, _ := under(name, m[best].source)
+	return m[best].target + rest
+}
+
+// source returns the db path delivered to target, the reverse of target.
+func (m pathMap) source(target string) string {
+	for i := len(m) - 1; i >= 0; i-- {
+		if rest, ok := under(target, m[i].target); ok {
+			if candidate := m[i].source + rest; m.target(candidate) == target {
+				return candidate
+			}
+		}
+	}
+
+	return target
+}
+
+// apply renames entries to where they are delivered.  Directories which
+// only held mapped paths are left out, the parents of mapped paths are
+// created, and the result is sorted so parents always precede children.
+func (m pathMap) apply(entries []manifest.Entry) []manifest.Entry {
+	var mapped []manifest.Entry
+
+	containers := make(map[string]bool)
+	for _, r := range m {
+		for dir := path.Dir(r.source); dir != "."; dir = path.Dir(dir) {
+			containers[dir] = true
+		}
+	}
+
+	present := make(map[string]bool)
+	for _, e := range entries {
+		if e.Path == MAPFILE {
+			continue
+		}
+
+		e.Path = m.target(e.Path)
+		if e.Type == manifest.TypeSymlink && !manifest.Contained(e.Path, e.Target) {
+			Warn("Skipping symlink %s -> %s which leaves the client root once mapped", e.Path, e.Target)
+			continue
+		}
+		if present[e.Path] {
+			Warn("%s: more than one db path is delivered to %s", MAPFILE, e.Path)
+			continue
+		}
+
+		present[e.Path] = true
+		mapped = append(mapped, e)
+	}
+
+	if len(m) == 0 {
+		return mapped
+	}
+
+	occupied := make(map[string]bool)
+	for _, e := range mapped {
+		for dir := path.Dir(e.Path); dir != "."; dir = path.Dir(dir) {
+			occupied[dir] = true
+		}
+	}
+
+	var kept []manifest.Entry
+	for _, e := range mapped {
+		if e.Type == manifest.TypeDir && containers[e.Path] && !occupied[e.Path] {
+			continue
+		}
+		kept = append(kept, e)
+	}
+
+	for dir := range occupied {
+		if !present[dir] {
+			kept = append(kept, manifest.Entry{Type: manifest.TypeDir, Path: dir, Mode: 0700 & modeMask()})
+		}
+	}
+
+	sort.SliceStable(kept, func(i, j int) bool {
+		return kept[i].Path < kept[j].Path
+	})
+
+	return kept
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitQuoted(t *testing.T) {
+	fields, err := splitQuoted(`config/nvim  "Library/Application Support/nvim"	os=Darwin`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"config/nvim", "Library/Application Support/nvim", "os=Darwin"}, fields)
+
+	fields, err = splitQuoted(`"say \"hi\"" plain`)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{`say "hi"`, "plain"}, fields)
+
+	_, err = splitQuoted(`config "unterminated`)
+	assert.NotNil(t, err)
+}
+
+// mapTree writes a db holding a .netskelmap and a few files to map.
+func mapTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+
+	os.MkdirAll(filepath.Join(root, "config/nvim"), 0755)
+	os.MkdirAll(filepath.Join(root, "config/git"), 0755)
+	ioutil.WriteFile(filepath.Join(root, MAPFILE), []byte(`# db path   target   conditions
+config/nvim  .config/nvim
+config/nvim  "Library/Application Support/nvim"  os=Darwin
+config/git   ${xdg_config_home}/git
+escape       ../outside
+`), 0644)
+	ioutil.WriteFile(filepath.Join(root, "config/nvim/init.vim"), []byte("set nocompatible\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, "config/git/config"), []byte("[user]\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, ".bashrc"), []byte("umask 077\n"), 0644)
+
+	return root
+}
+
+func TestPathMap(t *testing.T) {
+	root := mapTree(t)
+	defer os.RemoveAll(root)
+
+	s := newSession()
+	s.Options = url.Values{"fact": []string{"os=Linux"}}
+
+	paths, err := s.pathMap(dirTree{root})
+	assert.Nil(t, err)
+	assert.Len(t, paths, 1, "Applied a rule whose conditions or facts are missing")
+	assert.Equal(t, ".config/nvim/init.vim", paths.target("config/nvim/init.vim"))
+	assert.Equal(t, "config/git/config", paths.target("config/git/config"))
+	assert.Equal(t, "config/nvim/init.vim", paths.source(".config/nvim/init.vim"))
+	assert.Equal(t, ".bashrc", paths.source(".bashrc"))
+
+	s.Options = url.Values{"fact": []string{"os=Darwin", "xdg_config_home=.xdg"}}
+	paths, err = s.pathMap(dirTree{root})
+	assert.Nil(t, err)
+	assert.Equal(t, "Library/Application Support/nvim/init.vim", paths.target("config/nvim/init.vim"))
+	assert.Equal(t, ".xdg/git/config", paths.target("config/git/config"))
+}
+
+func TestPathMapApply(t *testing.T) {
+	root := mapTree(t)
+	defer os.RemoveAll(root)
+
+	s := newSession()
+	s.Options = url.Values{"fact": []string{"os=Linux", "xdg_config_home=.config"}}
+
+	paths, err := s.pathMap(dirTree{root})
+	assert.Nil(t, err)
+
+	entries, err := dirTree{root}.Entries()
+	assert.Nil(t, err)
+	entries = paths.apply(entries)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Path)
+	}
+	assert.Equal(t, []string{".bashrc", ".config", ".config/git", ".config/git/config", ".config/nvim", ".config/nvim/init.vim"}, names)
+	assert.Equal(t, manifest.TypeDir, entries[1].Type, "Parent of a mapped path was not created")
+}
+
+func TestNetskelDBMapped(t *testing.T) {
+	root := mapTree(t)
+	defer os.RemoveAll(root)
+
+	saved := DBDIR
+	DBDIR = root
+	defer func() { DBDIR = saved }()
+
+	clearStdout()
+	s := newSession()
+	s.Options = url.Values{"fact": []string{"os=Darwin"}}
+	assert.Nil(t, s.NetskelDB())
+	assert.Contains(t, stdoutBuffer, "Library/Application Support/nvim/init.vim\t")
+	assert.NotContains(t, stdoutBuffer, MAPFILE)
+
+	filename, err := s.snapshotFile("db/Library/Application Support/nvim/init.vim")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(root, "config/nvim/init.vim"), filename)
+
+	s.Options.Set("snapshot", manifestRevision(t, stdoutBuffer))
+	filename, err = s.snapshotFile("db/Library/Application Support/nvim/init.vim")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(filename, BLOBDIR), filename)
+}
+
+// manifestRevision returns the revision of a TSV manifest.
+func manifestRevision(t *testing.T, tsv string) string {
+	m, err := manifest.Parse(strings.NewReader(tsv))
+	assert.Nil(t, err)
+	return m.Revision
+}
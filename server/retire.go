@@ -0,0 +1,21 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// Retire records that a client has uninstalled netskel.  The client is
+// disabled too, so it drops out of the netskelctl client list.
+func (s *session) Retire() error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	for _, key := range []string{"retired", "disabled"} {
+		if err := clientPut(s.UUID, key, now); err != nil {
+			return err
+		}
+	}
+
+	Log("%s@%s uninstalled netskel, retired client %s", s.Username, s.Hostname, s.UUID)
+	return nil
+}
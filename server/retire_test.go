@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetire(t *testing.T) {
+	s := newSession()
+	s.UUID = "8b1e4d2a-6c3f-4f9e-a0d7-5e2b9c8f1a34"
+
+	assert.Nil(t, s.Retire())
+	assert.NotEmpty(t, clientGet(s.UUID, "retired"))
+	assert.Equal(t, clientGet(s.UUID, "retired"), clientGet(s.UUID, "disabled"))
+}
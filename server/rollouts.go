@@ -0,0 +1,94 @@
+package main
+
+import (
+	"hash/crc32"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// ROLLOUTDB is the filename of the staged rollout database, managed by
+// netskelctl.
+var ROLLOUTDB = "rollout.db"
+
+// rolloutBucket holds the settings of the fleet's rollout.
+var rolloutBucket = []byte("rollout")
+
+// A rollout moves the fleet from a stable commit to a target commit in
+// stages: first clients tagged canary, then a percentage of the fleet, then
+// everyone, at which point the rollout is over and the fleet goes back to
+// following its refs.  A rollout which was rolled back holds the fleet on
+// the stable commit until the next one starts.
+type rollout struct {
+	Stable  string
+	Target  string
+	Stage   string
+	Percent int
+	Paused  bool
+}
+
+// loadRollout reads the current rollout, which is empty if none was ever
+// started.
+func loadRollout() (r rollout) {
+	if _, err := os.Stat(ROLLOUTDB); err != nil {
+		return r
+	}
+
+	db, err := bolt.Open(ROLLOUTDB, 0660, &bolt.Options{ReadOnly: true, Timeout: 2 * time.Second})
+	if err != nil {
+		Warn("Unable to open rollout database: %v", err)
+		return r
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(rolloutBucket)
+		if b == nil {
+			return nil
+		}
+		r.Stable = string(b.Get([]byte("stable")))
+		r.Target = string(b.Get([]byte("target")))
+		r.Stage = string(b.Get([]byte("stage")))
+		r.Percent, _ = strconv.Atoi(string(b.Get([]byte("percent"))))
+		r.Paused = b.Get([]byte("paused")) != nil
+		return nil
+	})
+
+	return r
+}
+
+// rolloutBucketOf places a client at a fixed point between 0 and 99 so that
+// percentage stages always select the same clients.
+func rolloutBucketOf(uuid string) int {
+	return int(crc32.ChecksumIEEE([]byte(uuid)) % 100)
+}
+
+// commit picks the commit a client should see, or "" if the rollout has
+// nothing to say about it, as when none is in progress or held.  While
+// paused, only clients which already received the target keep it.
+func (r rollout) commit(uuid string, tags []string, current string) string {
+	if r.Target == "" {
+		return r.Stable
+	}
+
+	if r.Paused {
+		if current == r.Target {
+			return r.Target
+		}
+		return r.Stable
+	}
+
+	for _, tag := range tags {
+		if tag == "canary" {
+			return r.Target
+		}
+	}
+
+	if r.Stage == "percent" && rolloutBucketOf(uuid) < r.Percent {
+		return r.Target
+	}
+
+	return r.Stable
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRolloutCommit(t *testing.T) {
+	canary := []string{"canary"}
+	uuid := "6ec558e1-5f06-4083-9070-206819b53916"
+
+	var rolloutTests = []struct {
+		name    string
+		r       rollout
+		tags    []string
+		current string
+		out     string
+	}{
+		{"no rollout", rollout{}, nil, "", ""},
+		{"held after rollback", rollout{Stable: "aaa"}, canary, "", "aaa"},
+		{"canary stage, canary", rollout{Stable: "aaa", Target: "bbb", Stage: "canary"}, canary, "", "bbb"},
+		{"canary stage, fleet", rollout{Stable: "aaa", Target: "bbb", Stage: "canary"}, nil, "", "aaa"},
+		{"everyone", rollout{Stable: "aaa", Target: "bbb", Stage: "percent", Percent: 100}, nil, "", "bbb"},
+		{"nobody", rollout{Stable: "aaa", Target: "bbb", Stage: "percent", Percent: 0}, nil, "", "aaa"},
+		{"paused, received", rollout{Stable: "aaa", Target: "bbb", Stage: "canary", Paused: true}, nil, "bbb", "bbb"},
+		{"paused, canary", rollout{Stable: "aaa", Target: "bbb", Stage: "canary", Paused: true}, canary, "aaa", "aaa"},
+	}
+
+	for _, tt := range rolloutTests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.out, tt.r.commit(uuid, tt.tags, tt.current))
+		})
+	}
+}
+
+func TestRolloutPercent(t *testing.T) {
+	r := rollout{Stable: "aaa", Target: "bbb", Stage: "percent", Percent: 30}
+
+	selected := 0
+	for i := 0; i < 1000; i++ {
+		uuid := fmt.Sprintf("client-%d", i)
+		if r.commit(uuid, nil, "") == "bbb" {
+			selected++
+		}
+		assert.Equal(t, r.commit(uuid, nil, ""), r.commit(uuid, nil, "aaa"), "Selection was not stable")
+	}
+
+	assert.InDelta(t, 300, selected, 60, "Percentage stage selected the wrong share of the fleet")
+}
+
+func TestRolloutFinished(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(scratch)
+
+	saved := ROLLOUTDB
+	ROLLOUTDB = filepath.Join(scratch, "rollout.db")
+	defer func() { ROLLOUTDB = saved }()
+	defer delete(config, "gitref")
+
+	// What netskelctl leaves behind once a rollout reaches everyone
+	db, err := bolt.Open(ROLLOUTDB, 0660, nil)
+	assert.Nil(t, err)
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(rolloutBucket)
+		return b.Put([]byte("deployed"), []byte("bbb"))
+	})
+	db.Close()
+
+	uuid := "3d7f9b1a-5c2e-4a8d-b6f0-1e3c5a7d9f2b"
+	config["gitref"] = "refs/heads/release"
+	assert.Equal(t, "refs/heads/release", clientRef(uuid), "Finished rollout still decides the ref")
+}
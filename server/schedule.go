@@ -0,0 +1,42 @@
+package main
+
+import "github.com/nugget/netskel/manifest"
+
+// intervalSetting reads an interval setting in seconds, or 0 if it is unset
+// or not an interval.
+func intervalSetting(value string) int64 {
+	if value == "" {
+		return 0
+	}
+
+	secs, err := manifest.ParseInterval(value)
+	if err != nil {
+		Warn("Ignoring interval setting: %v", err)
+	}
+	return secs
+}
+
+// clientInterval picks how many seconds a client should wait before its next
+// sync.  An interval set on the client wins over one set on any of its
+// groups, which wins over the rollout_interval server setting while a
+// rollout is under way, which wins over the sync_interval server setting.
+// Zero leaves the client to its own schedule.
+func clientInterval(uuid string) int64 {
+	if secs := intervalSetting(clientGet(uuid, "interval")); secs > 0 {
+		return secs
+	}
+
+	for _, tag := range clientTags(uuid) {
+		if secs := intervalSetting(groupGet(tag, "interval")); secs > 0 {
+			return secs
+		}
+	}
+
+	if r := loadRollout(); r.Target != "" && !r.Paused {
+		if secs := intervalSetting(config["rollout_interval"]); secs > 0 {
+			return secs
+		}
+	}
+
+	return intervalSetting(config["sync_interval"])
+}
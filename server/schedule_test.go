@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntervalSetting(t *testing.T) {
+	assert.Equal(t, int64(5400), intervalSetting("90m"))
+	assert.Equal(t, int64(0), intervalSetting(""))
+	assert.Equal(t, int64(0), intervalSetting("soon"))
+}
+
+func TestClientInterval(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(scratch)
+
+	savedGroups, savedRollout := GROUPDB, ROLLOUTDB
+	GROUPDB = filepath.Join(scratch, "groups.db")
+	ROLLOUTDB = filepath.Join(scratch, "rollout.db")
+	defer func() { GROUPDB, ROLLOUTDB = savedGroups, savedRollout }()
+	defer func() { delete(config, "sync_interval"); delete(config, "rollout_interval") }()
+
+	uuid := "8a1f3c5e-2b4d-4f6a-9c8e-0d2b4f6a8c1e"
+	assert.Equal(t, int64(0), clientInterval(uuid), "Suggested an interval with nothing configured")
+
+	config["sync_interval"] = "4h"
+	assert.Equal(t, int64(14400), clientInterval(uuid))
+
+	config["rollout_interval"] = "15m"
+	db, err := bolt.Open(ROLLOUTDB, 0660, nil)
+	assert.Nil(t, err)
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists(rolloutBucket)
+		b.Put([]byte("stable"), []byte("aaa"))
+		return b.Put([]byte("target"), []byte("bbb"))
+	})
+	db.Close()
+	assert.Equal(t, int64(900), clientInterval(uuid), "Rollout interval was not applied")
+
+	db, err = bolt.Open(GROUPDB, 0660, nil)
+	assert.Nil(t, err)
+	db.Update(func(tx *bolt.Tx) error {
+		b, _ := tx.CreateBucketIfNotExists([]byte("laptops"))
+		return b.Put([]byte("interval"), []byte("43200"))
+	})
+	db.Close()
+	clientPut(uuid, "tags", "laptops")
+	assert.Equal(t, int64(43200), clientInterval(uuid), "Group interval was not applied")
+
+	clientPut(uuid, "interval", "600")
+	assert.Equal(t, int64(600), clientInterval(uuid), "Client interval was not applied")
+
+	// Served from the working tree, with no rollout to resolve
+	os.Remove(ROLLOUTDB)
+	clearStdout()
+	s := newSession()
+	s.UUID = uuid
+	s.Options = map[string][]string{"format": {"json"}}
+	assert.Nil(t, s.NetskelDB())
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(600), m.NextSync)
+}
@@ -10,14 +10,20 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/blackjack/syslog"
 	"github.com/boltdb/bolt"
 	"github.com/gofrs/uuid"
+	"github.com/nugget/netskel/manifest"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -27,6 +33,34 @@ var AUTHKEYSFILE = os.Getenv("HOME") + "/.ssh/authorized_keys"
 // CLIENTDB is the filename of the client database file.
 var CLIENTDB = "clients.db"
 
+// DBDIR is the directory holding the files served to clients.
+var DBDIR = "db"
+
+// GROUPDB is the filename of the client group settings database.
+var GROUPDB = "groups.db"
+
+// VERSION is the release of this netskel server.
+const VERSION = "3.1.0"
+
+// PROTOCOL is the newest protocol revision this server speaks.  Clients which
+// never say hello are assumed to speak revision 1.
+const PROTOCOL = 2
+
+// Error codes sent to clients in the structured ERROR response.
+const (
+	ErrSyntax     = 400
+	ErrPermission = 403
+	ErrNotFound   = 404
+	ErrInternal   = 500
+)
+
+// COMMANDS lists every command the server dispatches, as advertised by hello.
+var COMMANDS = []string{"hello", "netskeldb", "md5", "sendfile", "sendbase64", "rawclient", "addkey", "uname", "conflicts", "retire"}
+
+// TRAILER marks the end-of-stream line which follows every encoded file
+// payload so that clients can tell a complete transfer from a truncated one.
+const TRAILER = "#NETSKEL-EOF"
+
 var Send = fmt.Printf
 var Sendln = fmt.Println
 
@@ -58,6 +92,7 @@ type session struct {
 	Username   string
 	Hostname   string
 	Command    string
+	Options    url.Values
 }
 
 func newSession() session {
@@ -83,7 +118,7 @@ func (s *session) Parse(nsCommand []string) {
 	case "addkey":
 		usernamePosition = 1
 		hostnamePosition = 2
-	case "netskeldb":
+	case "netskeldb", "conflicts", "retire":
 		uuidPosition = 1
 		usernamePosition = 2
 		hostnamePosition = 3
@@ -113,23 +148,176 @@ func (s *session) Parse(nsCommand []string) {
 	}
 }
 
-func (s *session) NetskelDB() {
-	servername, _ := os.Hostname()
-	now := time.Now().Format("Mon, 2 Jan 2006 15:04:05 UTC")
+// protocol is the protocol revision the client says it speaks.
+func (s *session) protocol() int {
+	proto, err := strconv.Atoi(s.Options.Get("proto"))
+	if err != nil || proto < 1 {
+		return 1
+	}
+
+	return proto
+}
 
-	Send("#\n# .netskeldb for %s at %v\n#\n# Generated %v by %v\n#\n", s.UUID, s.RemoteAddr, now, servername)
+func (s *session) NetskelDB() error {
+	s.recordFacts()
+
+	m, err := s.buildManifest()
+	if err != nil {
+		return err
+	}
+
+	m.Client = s.UUID
+	m.Address = s.RemoteAddr
+	m.Generator, _ = os.Hostname()
+	m.NextSync = clientInterval(s.UUID)
+
+	if since := s.Options.Get("since"); since == m.Revision {
+		m.Entries = nil
+		m.NotModified = true
+	}
+
+	switch format := s.Options.Get("format"); format {
+	case "", "tsv":
+		if s.protocol() < 2 {
+			// The original client would try to fetch these
+			m = m.Without(manifest.TypeTombstone, manifest.TypeSymlink)
+		}
+		err = m.WriteTSV(sendWriter{})
+	case "json":
+		err = m.WriteJSON(sendWriter{})
+	default:
+		return fmt.Errorf("Unknown manifest format %s", format)
+	}
+	if err != nil {
+		return err
+	}
+
+	if m.NotModified {
+		Log("Sent netskeldb not modified at %s to %s@%s at %s (%s)", m.Revision, s.Username, s.Hostname, s.RemoteAddr, s.UUID)
+		return nil
+	}
+
+	if _, ok := s.Options["dry-run"]; ok {
+		// The client will only report on this manifest, not apply it
+		Log("Sent dry run netskeldb %s to %s@%s at %s (%s)", m.Revision, s.Username, s.Hostname, s.RemoteAddr, s.UUID)
+		return nil
+	}
+
+	s.recordRevision(m)
+
+	Log("Sent netskeldb %s to %s@%s at %s (%s)", m.Revision, s.Username, s.Hostname, s.RemoteAddr, s.UUID)
+	return nil
+}
+
+// buildManifest assembles the manifest this client should receive.  A
+// client pinned to a snapshot gets that snapshot again, with tombstones for
+// whatever it has received since, while anyone else gets the current state
+// of their tree, stored as a new snapshot.
+func (s *session) buildManifest() (*manifest.Manifest, error) {
+	if pin := s.snapshotPin(); pin != "" {
+		Debug("Client %s is pinned to snapshot %s", s.UUID, pin)
+		return s.pinnedManifest(pin)
+	}
+
+	m := manifest.New()
 
 	// Force-inject the client itself
-	dbDirLine("bin")
-	dbFileLine("bin/netskel")
+	m.Entries = append(m.Entries, dirEntry(".", "bin"))
+	if e, err := fileEntry(".", "bin/netskel"); err == nil {
+		m.Entries = append(m.Entries, e)
+	}
+	fingerprintEntries(".", m.Entries)
+
+	t, err := s.tree()
+	if err != nil {
+		return nil, err
+	}
+	if g, ok := t.(*gitTree); ok {
+		m.Commit = g.commit
+	}
 
-	os.Chdir("db")
-	err := listDir(".")
+	entries, err := t.Entries()
 	if err != nil {
 		Warn("Error listing directory: %v", err)
-	} else {
-		Log("Sent netskeldb to %s@%s at %s (%s)", s.Username, s.Hostname, s.RemoteAddr, s.UUID)
+		return nil, err
+	}
+
+	entries, err = applyMeta(t, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storeBlobs(dirTree{"."}, m.Entries); err != nil {
+		return nil, err
+	}
+	if err := storeBlobs(t, entries); err != nil {
+		return nil, err
 	}
+
+	paths, err := s.pathMap(t)
+	if err != nil {
+		return nil, err
+	}
+	entries = paths.apply(entries)
+
+	m.Entries = append(m.Entries, entries...)
+	m.Entries = append(m.Entries, s.tombstones(m.Entries)...)
+	m.Revision = m.Merkle()
+
+	if err := storeSnapshot(m); err != nil {
+		return nil, err
+	}
+	if err := collectGarbage(); err != nil {
+		Warn("Unable to clean up old snapshots: %v", err)
+	}
+
+	return m, nil
+}
+
+// recordRevision remembers which revision a client was sent, along with the
+// one before it, so netskelctl can freeze or roll back the client.
+func (s *session) recordRevision(m *manifest.Manifest) {
+	if previous := clientGet(s.UUID, "revision"); previous != "" && previous != m.Revision {
+		clientPut(s.UUID, "previousRevision", previous)
+	}
+
+	clientPut(s.UUID, "revision", m.Revision)
+	clientPut(s.UUID, "commit", m.Commit)
+}
+
+// pinnedManifest rebuilds the snapshot pin for a client which may since have
+// received newer revisions.  The snapshot's own tombstones describe how it
+// differed from some older revision, so they are replaced with tombstones
+// against the revision the client last received.  The revision stays the
+// pin, so files are still fetched from the snapshot.
+func (s *session) pinnedManifest(pin string) (*manifest.Manifest, error) {
+	m, err := loadSnapshot(pin)
+	if err != nil {
+		return nil, fmt.Errorf("Pinned snapshot %s is unavailable: %v", pin, err)
+	}
+
+	m = m.Without(manifest.TypeTombstone)
+	m.Entries = append(m.Entries, s.tombstones(m.Entries)...)
+
+	return m, nil
+}
+
+// snapshotPin returns the snapshot a client has been pinned to by
+// netskelctl, if any.  A client pinned to a git commit has a pinRef instead,
+// which clientRef looks after.
+func (s *session) snapshotPin() string {
+	return clientGet(s.UUID, "pin")
+}
+
+// tree returns the db tree this client should be served: a git ref when
+// one applies to the client, otherwise the db working tree.
+func (s *session) tree() (tree, error) {
+	ref := clientRef(s.UUID)
+	if ref == "" {
+		return dirTree{DBDIR}, nil
+	}
+
+	return openGitTree(DBDIR, ref)
 }
 
 func (s *session) Heartbeat() {
@@ -144,40 +332,184 @@ func (s *session) Heartbeat() {
 	Debug("Stored heartbeat for %v", s.UUID)
 }
 
-func syntaxError() {
-	Send("ERROR\n")
+// Hello describes this server's capabilities so clients can adapt to it.
+func (s *session) Hello() {
+	servername, _ := os.Hostname()
+
+	Send("NETSKEL\t%s\t%s\n", VERSION, servername)
+	Send("protocol\t%d\n", PROTOCOL)
+	Send("hashes\tmd5\n")
+	Send("encodings\tbase64 hex raw\n")
+	Send("formats\ttsv json\n")
+	Send("arguments\tescaped\n")
+	Send("commands\t%s\n", strings.Join(COMMANDS, " "))
+
+	Debug("Sent hello to %s", s.RemoteAddr)
+}
+
+// sendError reports a failure to the client as a single ERROR line carrying
+// a numeric code and a human readable message.  Clients which predate the
+// structured format only ever look for the leading ERROR token.
+func sendError(code int, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	Warn("Error %d: %s", code, message)
+	Send("ERROR %d %s\n", code, message)
+}
+
+// fail reports an error to the client and aborts the session.
+func fail(code int, format string, a ...interface{}) {
+	sendError(code, format, a...)
 	os.Exit(1)
 }
 
-func dbFileLine(filename string) {
+// errorCode picks the ERROR code which best describes err.
+func errorCode(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return ErrNotFound
+	case os.IsPermission(err):
+		return ErrPermission
+	}
+	return ErrInternal
+}
+
+// requireArgs aborts with a syntax error unless nsCommand has at least count
+// positional arguments following the command itself.
+func requireArgs(nsCommand []string, count int) {
+	if len(nsCommand) <= count {
+		fail(ErrSyntax, "%s requires %d arguments", nsCommand[0], count)
+	}
+}
+
+// sendWriter adapts Send for use as an io.Writer.
+type sendWriter struct{}
+
+func (sendWriter) Write(p []byte) (int, error) {
+	if _, err := Send("%s", p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// splitOptions separates the --key=value options in a client command from
+// its positional arguments.  Options may appear anywhere after the command.
+func splitOptions(nsCommand []string) ([]string, url.Values) {
+	var (
+		args    []string
+		options url.Values
+	)
+
+	for i, arg := range nsCommand {
+		if i == 0 || !strings.HasPrefix(arg, "--") {
+			args = append(args, arg)
+			continue
+		}
+
+		if options == nil {
+			options = url.Values{}
+		}
+		kv := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+		options.Add(strings.ToLower(kv[0]), kv[1])
+	}
+
+	return args, options
+}
+
+// unescapeArgs decodes the URL path escaping of the arguments and option
+// values of a client which sent --escaped, allowing them to hold spaces.
+func unescapeArgs(nsCommand []string, options url.Values) ([]string, error) {
+	args := make([]string, len(nsCommand))
+	for i, arg := range nsCommand {
+		unescaped, err := url.PathUnescape(arg)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = unescaped
+	}
+
+	for key, values := range options {
+		for i, value := range values {
+			unescaped, err := url.PathUnescape(value)
+			if err != nil {
+				return nil, err
+			}
+			options[key][i] = unescaped
+		}
+	}
+
+	return args, nil
+}
+
+func fileEntry(root, name string) (manifest.Entry, error) {
+	e := manifest.Entry{Type: manifest.TypeFile, Path: name}
+	filename := filepath.Join(root, name)
+
 	file, err := os.Stat(filename)
 	if err != nil {
 		Warn("Error Stat %v: %v", filename, err)
-		return
+		return e, err
 	}
 
-	trimmed := strings.TrimPrefix(filename, "./")
+	e.Size = file.Size()
+	e.MTime = file.ModTime().Unix()
 
-	hash, _ := fingerprint(filename)
+	e.Mode = uint32(file.Mode().Perm()) & modeMask()
+
+	return e, nil
+}
 
-	mode := 0600
-	if file.Mode()&0111 != 0 {
-		mode = 0700
+func dirEntry(root, name string) manifest.Entry {
+	e := manifest.Entry{Type: manifest.TypeDir, Path: name, Mode: 0700 & modeMask()}
+
+	if dir, err := os.Stat(filepath.Join(root, name)); err == nil {
+		e.Mode = uint32(dir.Mode().Perm()) & modeMask()
+		e.MTime = dir.ModTime().Unix()
 	}
 
-	Send("%s\t%o\t*\t%d\t%x\n", trimmed, mode, file.Size(), hash)
+	return e
 }
 
-func dbDirLine(directory string) {
-	trimmed := strings.TrimPrefix(directory, "./")
-	Send("%s/\t%d\t*\n", trimmed, 700)
+func symlinkEntry(root, name string) (manifest.Entry, error) {
+	e := manifest.Entry{Type: manifest.TypeSymlink, Path: name, Mode: 0777}
+	filename := filepath.Join(root, name)
+
+	link, err := os.Lstat(filename)
+	if err != nil {
+		Warn("Error Lstat %v: %v", filename, err)
+		return e, err
+	}
+
+	e.Target, err = os.Readlink(filename)
+	if err != nil {
+		Warn("Error Readlink %v: %v", filename, err)
+		return e, err
+	}
+
+	if !manifest.Contained(name, e.Target) {
+		Warn("Skipping symlink %s -> %s which leaves the db", name, e.Target)
+		return e, fmt.Errorf("Symlink %s leaves the db", name)
+	}
+
+	e.Size = int64(len(e.Target))
+	e.MTime = link.ModTime().Unix()
+
+	return e, nil
 }
 
-func listDir(dirname string) error {
+// collectDir walks the directory rel beneath root and returns an entry for
+// every directory, regular file and symlink it holds, named relative to
+// root.  Symlinks are described, never followed.
+func collectDir(root, rel string) ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+
+	dirname := filepath.Join(root, rel)
 	files, err := ioutil.ReadDir(dirname)
 	if err != nil {
 		Warn("Error reading directory %v", dirname)
-		return err
+		return entries, err
 	}
 
 	for _, file := range files {
@@ -185,26 +517,32 @@ func listDir(dirname string) error {
 			continue
 		}
 
-		fullname := dirname + "/" + file.Name()
+		name := path.Join(rel, file.Name())
 
 		switch mode := file.Mode(); {
 		case mode.IsDir():
-			dbDirLine(fullname)
-			err := listDir(fullname)
+			entries = append(entries, dirEntry(root, name))
+			children, err := collectDir(root, name)
 			if err != nil {
-				return err
+				return entries, err
 			}
+			entries = append(entries, children...)
 		case mode.IsRegular():
-			dbFileLine(fullname)
+			if e, err := fileEntry(root, name); err == nil {
+				entries = append(entries, e)
+			}
+		case mode&os.ModeSymlink != 0:
+			if e, err := symlinkEntry(root, name); err == nil {
+				entries = append(entries, e)
+			}
 		}
 	}
 
-	return nil
+	return entries, nil
 }
 
 func (s *session) SendBase64(filename string) error {
 	linelength := 76
-	count := 0
 
 	file, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -213,42 +551,62 @@ func (s *session) SendBase64(filename string) error {
 
 	str := base64.StdEncoding.EncodeToString(file)
 
-	for _, c := range str {
-		Send("%c", c)
-		count++
-		if count >= linelength {
-			count = 0
-			Send("\n")
-		}
+	for len(str) > linelength && err == nil {
+		_, err = Send("%s\n", str[:linelength])
+		str = str[linelength:]
+	}
+	if err == nil {
+		_, err = Send("%s\n", str)
+	}
+	if err == nil {
+		err = sendTrailer(file)
 	}
-	Send("\n")
 
-	Log("Sent base64 %s (%d bytes) to %s@%s at %s (%s)", filename, len(file), s.Username, s.Hostname, s.RemoteAddr, s.UUID)
+	s.logTransfer("base64", filename, len(file), err)
 
-	return nil
+	return err
 }
 
 func (s *session) SendHexdump(filename string) error {
 	linelength := 30
-	count := 0
 
 	file, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return err
 	}
 
-	for _, c := range file {
-		Send("%02x", c)
-		count++
-		if count >= linelength {
-			count = 0
-			Send("\n")
-		}
+	remaining := file
+	for len(remaining) > linelength && err == nil {
+		_, err = Send("%x\n", remaining[:linelength])
+		remaining = remaining[linelength:]
+	}
+	if err == nil {
+		_, err = Send("%x\n", remaining)
+	}
+	if err == nil {
+		err = sendTrailer(file)
 	}
-	Send("\n")
-	Log("Sent hexdump %s (%d bytes) to %s@%s at %s (%s)", filename, len(file), s.Username, s.Hostname, s.RemoteAddr, s.UUID)
 
-	return nil
+	s.logTransfer("hexdump", filename, len(file), err)
+
+	return err
+}
+
+// sendTrailer writes the end-of-stream line for a file payload.  It carries
+// the decoded size and the same fingerprint used in the netskeldb manifest.
+func sendTrailer(file []byte) error {
+	_, err := Send("%s\t%d\t%x\n", TRAILER, len(file), md5.Sum(file))
+	return err
+}
+
+// logTransfer records whether a file payload reached the client intact.
+func (s *session) logTransfer(encoding, filename string, size int, err error) {
+	if err != nil {
+		Warn("Incomplete %s %s (%d bytes) to %s@%s at %s (%s): %v", encoding, filename, size, s.Username, s.Hostname, s.RemoteAddr, s.UUID, err)
+		return
+	}
+
+	Log("Sent %s %s (%d bytes) to %s@%s at %s (%s)", encoding, filename, size, s.Username, s.Hostname, s.RemoteAddr, s.UUID)
 }
 
 func (s *session) SendRaw(filename string) error {
@@ -375,82 +733,179 @@ func clientGet(uuid, key string) (retval string) {
 	return retval
 }
 
+// groupGet retrieves the value of a key in a group's settings.
+func groupGet(group, key string) (retval string) {
+	if _, err := os.Stat(GROUPDB); err != nil {
+		return ""
+	}
+
+	db, err := bolt.Open(GROUPDB, 0660, &bolt.Options{ReadOnly: true, Timeout: 2 * time.Second})
+	if err != nil {
+		Warn("Unable to open group database: %v\n", err)
+		return ""
+	}
+	defer db.Close()
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(group))
+		if b == nil {
+			return nil
+		}
+		retval = string(b.Get([]byte(key)))
+		return nil
+	})
+
+	return retval
+}
+
+// clientTags lists the groups a client has been tagged with.
+func clientTags(uuid string) []string {
+	tags := clientGet(uuid, "tags")
+	if tags == "" {
+		return nil
+	}
+
+	return strings.Split(tags, ",")
+}
+
+// clientRef picks the git ref a client is served from.  A commit the client
+// is pinned to wins over a ref set on the client, which wins over one set on
+// any of its groups, which wins over a staged rollout, which wins over the
+// gitref server setting.  No ref at all means the db working tree.
+func clientRef(uuid string) string {
+	if pin := clientGet(uuid, "pinRef"); pin != "" {
+		return pin
+	}
+
+	if ref := clientGet(uuid, "ref"); ref != "" {
+		return ref
+	}
+
+	tags := clientTags(uuid)
+	for _, tag := range tags {
+		if ref := groupGet(tag, "ref"); ref != "" {
+			return ref
+		}
+	}
+
+	if commit := loadRollout().commit(uuid, tags, clientGet(uuid, "commit")); commit != "" {
+		return commit
+	}
+
+	return config["gitref"]
+}
+
 func main() {
 	syslog.Openlog("netskel-server", syslog.LOG_PID, syslog.LOG_USER)
 
+	if err := loadConfig(); err != nil {
+		Warn("Unable to read %s: %v", CONFIGFILE, err)
+	}
+
+	// A client that hangs up mid-transfer should surface as a write error we
+	// can log rather than silently killing the server with SIGPIPE.
+	signal.Ignore(syscall.SIGPIPE)
+
 	s := newSession()
 
-	if os.Args[0] != "server" {
-		syntaxError()
+	if os.Args[0] != "server" || len(os.Args) < 3 {
+		fail(ErrSyntax, "netskel server must be invoked as a login shell")
 	}
 
-	nsCommand := strings.Split(os.Args[2], " ")
+	nsCommand, options := splitOptions(strings.Split(os.Args[2], " "))
+	if _, ok := options["escaped"]; ok {
+		var err error
+		if nsCommand, err = unescapeArgs(nsCommand, options); err != nil {
+			fail(ErrSyntax, "Malformed escaped arguments: %v", err)
+		}
+	}
+	s.Options = options
 	s.Command = strings.ToLower(nsCommand[0])
 
 	Debug("Launched from %v with %v", s.RemoteAddr, nsCommand)
 
 	switch s.Command {
+	case "hello":
+		s.Hello()
+
 	case "netskeldb":
 		s.Parse(nsCommand)
 		s.Heartbeat()
-		s.NetskelDB()
+		if err := s.NetskelDB(); err != nil {
+			fail(errorCode(err), "Unable to generate netskeldb: %v", err)
+		}
 
 	case "md5":
+		requireArgs(nsCommand, 1)
 		filename := nsCommand[1]
 		hash, err := fingerprint(filename)
 		if err != nil {
-			Fatal("Unable to determine fingerprint for %s: %v", filename, err)
+			fail(errorCode(err), "Unable to determine fingerprint for %s: %v", filename, err)
 		}
 		Sendln(hash)
 
 	case "sendfile":
+		requireArgs(nsCommand, 1)
 		s.Parse(nsCommand)
-		filename := nsCommand[1]
-
-		if filename == "db/bin/netskel" {
-			filename = "bin/netskel"
+		filename, err := s.snapshotFile(nsCommand[1])
+		if err != nil {
+			fail(errorCode(err), "Unable to find %s: %v", nsCommand[1], err)
 		}
 
-		err := s.SendHexdump(filename)
+		err = s.SendHexdump(filename)
 		if err != nil {
-			Warn("Unable to SendHexDump %s: %v", filename, err)
+			fail(errorCode(err), "Unable to SendHexDump %s: %v", filename, err)
 		}
 
 	case "sendbase64":
+		requireArgs(nsCommand, 1)
 		s.Parse(nsCommand)
-		filename := nsCommand[1]
-
-		if filename == "db/bin/netskel" {
-			filename = "bin/netskel"
+		filename, err := s.snapshotFile(nsCommand[1])
+		if err != nil {
+			fail(errorCode(err), "Unable to find %s: %v", nsCommand[1], err)
 		}
 
-		err := s.SendBase64(filename)
+		err = s.SendBase64(filename)
 		if err != nil {
-			Warn("Unable to SendBase64 %s: %v", filename, err)
+			fail(errorCode(err), "Unable to SendBase64 %s: %v", filename, err)
 		}
 
 	case "rawclient":
 		filename := "bin/netskel"
 		err := s.SendRaw(filename)
 		if err != nil {
-			Warn("Unable to SendRaw %s: %v", filename, err)
+			fail(errorCode(err), "Unable to SendRaw %s: %v", filename, err)
 		}
 
 	case "addkey":
 		s.Parse(nsCommand)
 		err := s.AddKey()
 		if err != nil {
-			Warn("Error in AddKey: %v", err)
-			os.Exit(1)
+			fail(ErrInternal, "Error in AddKey: %v", err)
 		}
 
 	case "uname":
+		requireArgs(nsCommand, 4)
 		s.Parse(nsCommand)
 		uname := nsCommand[4]
 		clientPut(s.UUID, "uname", uname)
 
+	case "conflicts":
+		requireArgs(nsCommand, 1)
+		s.Parse(nsCommand)
+		if err := s.RecordConflicts(); err != nil {
+			fail(errorCode(err), "Unable to record conflicts: %v", err)
+		}
+
+	case "retire":
+		requireArgs(nsCommand, 1)
+		s.Parse(nsCommand)
+		if err := s.Retire(); err != nil {
+			fail(errorCode(err), "Unable to retire client: %v", err)
+		}
+
 	default:
-		syntaxError()
+		fail(ErrSyntax, "Unknown command %s", s.Command)
 	}
 
 	os.Exit(0)
@@ -1,13 +1,18 @@
 package main
 
 import (
+	"crypto/md5"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"testing"
 
+	"github.com/nugget/netskel/manifest"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -31,6 +36,9 @@ var (
 	DATAFILE     string
 )
 
+// helloTrailer is the end-of-stream line expected after sending DATAFILE.
+const helloTrailer = TRAILER + "\t14\t746308829575e17c3331bbcb00c0898b\n"
+
 func clearStdout() {
 	stdoutBuffer = ""
 }
@@ -110,6 +118,17 @@ func TestParsing(t *testing.T) {
 	}
 }
 
+func TestProtocol(t *testing.T) {
+	s := newSession()
+	assert.Equal(t, 1, s.protocol())
+
+	s.Options = url.Values{"proto": []string{"2"}}
+	assert.Equal(t, 2, s.protocol())
+
+	s.Options = url.Values{"proto": []string{"bogus"}}
+	assert.Equal(t, 1, s.protocol())
+}
+
 func TestNetskelDB(t *testing.T) {
 	clearStdout()
 	s := newSession()
@@ -120,18 +139,134 @@ func TestNetskelDB(t *testing.T) {
 	assert.Contains(t, stdoutBuffer, "bin/", "Netskeldb was not generated correctly")
 }
 
-func TestListDirParent(t *testing.T) {
-	// This will hit the ".git" special handling and directory handling code
+func TestNetskelDBJSON(t *testing.T) {
+	clearStdout()
+	s := newSession()
+	s.Options = url.Values{"format": []string{"json"}}
+
+	err := s.NetskelDB()
+	assert.Nil(t, err)
+
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err, "JSON netskeldb did not parse")
+
+	paths := make(map[string]string)
+	for _, e := range m.Entries {
+		paths[e.Path] = e.Type
+	}
+	assert.Equal(t, manifest.TypeFile, paths["server.go"], "Netskeldb was not generated correctly")
+	assert.Equal(t, manifest.TypeDir, paths["bin"], "Netskeldb was not generated correctly")
+}
+
+func TestNetskelDBNotModified(t *testing.T) {
+	clearStdout()
+	s := newSession()
+	s.NetskelDB()
+
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, m.Revision, "Netskeldb carried no revision")
+	assert.False(t, m.NotModified)
+
+	clearStdout()
+	s.Options = url.Values{"since": []string{m.Revision}}
+	s.NetskelDB()
+
+	again, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err)
+	assert.True(t, again.NotModified, "Unchanged netskeldb was resent")
+	assert.Equal(t, m.Revision, again.Revision)
+	assert.Empty(t, again.Entries)
+}
+
+func TestNetskelDBDryRun(t *testing.T) {
 	clearStdout()
-	err := listDir("..")
+	s := newSession()
+	s.UUID = "5d0c1a9e-7f3b-4c2a-8e61-2b9f4d7a0c15"
+	s.Options = url.Values{"dry-run": []string{""}}
+
+	assert.Nil(t, s.NetskelDB())
+
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
 	assert.Nil(t, err)
-	assert.Contains(t, stdoutBuffer, "700", "I expected at least one directory")
-	assert.NotContains(t, stdoutBuffer, ".git/", "The git directory should be ignored")
+	assert.NotEmpty(t, m.Entries, "Dry run was sent no entries")
+	assert.Empty(t, clientGet(s.UUID, "revision"), "Dry run was recorded as delivered")
 }
 
-func TestListDirNotFound(t *testing.T) {
+func TestNetskelDBUnknownFormat(t *testing.T) {
 	clearStdout()
-	err := listDir("/this/directory/does/not/exist")
+	s := newSession()
+	s.Options = url.Values{"format": []string{"yaml"}}
+
+	err := s.NetskelDB()
+	assert.NotNil(t, err)
+}
+
+func TestSplitOptions(t *testing.T) {
+	args, options := splitOptions(strings.Split("netskeldb --format=json 6ec558e1 luser --Dry host", " "))
+
+	assert.Equal(t, []string{"netskeldb", "6ec558e1", "luser", "host"}, args)
+	assert.Equal(t, "json", options.Get("format"))
+	assert.Contains(t, options, "dry")
+
+	args, options = splitOptions([]string{"addkey", "luser", "host"})
+	assert.Equal(t, []string{"addkey", "luser", "host"}, args)
+	assert.Nil(t, options)
+}
+
+func TestUnescapeArgs(t *testing.T) {
+	args, options := splitOptions([]string{"sendbase64", "--escaped", "--fact=os=Darwin%20Kernel", "db/Application%20Support/init.vim", "uuid"})
+
+	args, err := unescapeArgs(args, options)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"sendbase64", "db/Application Support/init.vim", "uuid"}, args)
+	assert.Equal(t, "os=Darwin Kernel", options.Get("fact"))
+
+	_, err = unescapeArgs([]string{"sendbase64", "db/%zz"}, nil)
+	assert.NotNil(t, err)
+}
+
+func TestDirTreeParent(t *testing.T) {
+	// This will hit the ".git" special handling and directory handling code
+	entries, err := dirTree{".."}.Entries()
+	assert.Nil(t, err)
+
+	dirs := 0
+	for _, e := range entries {
+		if e.Type == manifest.TypeDir {
+			dirs++
+		}
+		assert.False(t, e.Path == ".git" || strings.HasPrefix(e.Path, ".git/"), "The git directory should be ignored")
+	}
+	assert.NotZero(t, dirs, "I expected at least one directory")
+}
+
+func TestCollectDirSymlinks(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	os.MkdirAll(filepath.Join(root, ".config/nvim"), 0755)
+	ioutil.WriteFile(filepath.Join(root, ".config/nvim/init.vim"), []byte("set nocompatible\n"), 0644)
+	os.Symlink(".config/nvim/init.vim", filepath.Join(root, ".vimrc"))
+	os.Symlink("../clients.db", filepath.Join(root, ".escape"))
+	os.Symlink("/etc/passwd", filepath.Join(root, ".absolute"))
+
+	entries, err := collectDir(root, "")
+	assert.Nil(t, err)
+
+	byPath := make(map[string]manifest.Entry)
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	assert.Equal(t, manifest.TypeSymlink, byPath[".vimrc"].Type)
+	assert.Equal(t, ".config/nvim/init.vim", byPath[".vimrc"].Target)
+	assert.NotContains(t, byPath, ".escape", "Served a symlink leaving the db")
+	assert.NotContains(t, byPath, ".absolute", "Served a symlink leaving the db")
+}
+
+func TestDirTreeNotFound(t *testing.T) {
+	_, err := dirTree{"/this/directory/does/not/exist"}.Entries()
 	assert.True(t, os.IsNotExist(err))
 }
 
@@ -172,7 +307,7 @@ func TestSendHexdump(t *testing.T) {
 
 	err := s.SendHexdump(DATAFILE)
 	assert.Nil(t, err, "SendHexdump exited with an error")
-	assert.Equal(t, "48656c6c6f2c20776f726c64210a\n", stdoutBuffer, "File was not sent correctly")
+	assert.Equal(t, "48656c6c6f2c20776f726c64210a\n"+helloTrailer, stdoutBuffer, "File was not sent correctly")
 }
 
 func TestSendHexdumpNotFound(t *testing.T) {
@@ -189,7 +324,27 @@ func TestSendBase64(t *testing.T) {
 
 	err := s.SendBase64(DATAFILE)
 	assert.Nil(t, err, "SendBase64 exited with an error")
-	assert.Equal(t, "SGVsbG8sIHdvcmxkIQo=\n", stdoutBuffer, "File was not sent correctly.")
+	assert.Equal(t, "SGVsbG8sIHdvcmxkIQo=\n"+helloTrailer, stdoutBuffer, "File was not sent correctly.")
+}
+
+func TestSendTrailerMultiline(t *testing.T) {
+	clearStdout()
+	s := newSession()
+
+	payload := []byte(strings.Repeat("0123456789", 30))
+	ioutil.WriteFile("multiline.dat", payload, 0644)
+	defer os.Remove("multiline.dat")
+
+	err := s.SendBase64("multiline.dat")
+	assert.Nil(t, err, "SendBase64 exited with an error")
+
+	lines := strings.Split(strings.TrimSuffix(stdoutBuffer, "\n"), "\n")
+	trailer := lines[len(lines)-1]
+	assert.Equal(t, fmt.Sprintf("%s\t%d\t%x", TRAILER, len(payload), md5.Sum(payload)), trailer)
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines[:len(lines)-1], ""))
+	assert.Nil(t, err, "Payload was not valid base64")
+	assert.Equal(t, payload, decoded, "Payload was not sent correctly")
 }
 
 func TestSendBase64NotFound(t *testing.T) {
@@ -228,8 +383,42 @@ func TestAddKey(t *testing.T) {
 	assert.Equal(t, s.Hostname, clientGet(s.UUID, "originalHostname"))
 }
 
+func TestHello(t *testing.T) {
+	clearStdout()
+	s := newSession()
+
+	s.Hello()
+
+	assert.Regexp(t, `^NETSKEL\t`+regexp.QuoteMeta(VERSION)+`\t`, stdoutBuffer, "Hello did not lead with the server version")
+	assert.Contains(t, stdoutBuffer, fmt.Sprintf("protocol\t%d\n", PROTOCOL))
+	assert.Contains(t, stdoutBuffer, "hashes\tmd5\n")
+	assert.Contains(t, stdoutBuffer, "formats\ttsv json\n")
+	assert.Contains(t, stdoutBuffer, "arguments\tescaped\n")
+	assert.Contains(t, stdoutBuffer, "netskeldb md5 sendfile sendbase64")
+}
+
+func TestSendError(t *testing.T) {
+	clearStdout()
+
+	sendError(ErrSyntax, "Unknown command %s", "bogus")
+
+	assert.Equal(t, "ERROR 400 Unknown command bogus\n", stdoutBuffer)
+}
+
+func TestErrorCode(t *testing.T) {
+	_, err := os.Open("/this/file/does/not/exist")
+	assert.Equal(t, ErrNotFound, errorCode(err))
+	assert.Equal(t, ErrPermission, errorCode(os.ErrPermission))
+	assert.Equal(t, ErrInternal, errorCode(fmt.Errorf("write error")))
+}
+
 func TestMain(m *testing.M) {
 	CLIENTDB = "testing.db"
+	DBDIR = "."
+	scratch, _ := ioutil.TempDir("", "netskel")
+	HASHCACHE = filepath.Join(scratch, "fingerprints.db")
+	BLOBDIR = filepath.Join(scratch, "blobs")
+	SNAPSHOTDIR = filepath.Join(scratch, "snapshots")
 	DATAFILE = "sample.dat"
 	AUTHKEYSFILE = "testing_keys"
 
@@ -239,6 +428,7 @@ func TestMain(m *testing.M) {
 	code := m.Run()
 
 	os.Remove(CLIENTDB)
+	os.RemoveAll(scratch)
 	os.Remove(DATAFILE)
 	os.Remove(AUTHKEYSFILE)
 
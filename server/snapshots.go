@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/nugget/netskel/manifest"
+)
+
+// BLOBDIR is the content-addressed store holding every file version which
+// has appeared in a manifest, named by fingerprint.
+var BLOBDIR = "blobs"
+
+// SNAPSHOTDIR holds the manifest of every revision sent to a client, so that
+// later fetches can be served exactly the content the manifest described.
+var SNAPSHOTDIR = "snapshots"
+
+// validID matches the fingerprints and revisions we accept from clients.
+var validID = regexp.MustCompile(`^[0-9a-f]{8,64}$`)
+
+func blobPath(hash string) string {
+	return filepath.Join(BLOBDIR, hash[:2], hash)
+}
+
+func snapshotPath(revision string) string {
+	return filepath.Join(SNAPSHOTDIR, revision+".json")
+}
+
+// writeAtomic writes data to a temporary file alongside filename and renames
+// it into place, so readers never see a partial file.
+func writeAtomic(filename string, data []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0750); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filename)
+}
+
+// storeBlobs copies every file entry of t into the blob store.  A file which
+// changed after it was fingerprinted has its entry corrected to describe the
+// content actually stored, so the manifest never promises bytes we can't
+// deliver.
+func storeBlobs(t tree, entries []manifest.Entry) error {
+	for i, e := range entries {
+		if e.Type != manifest.TypeFile {
+			continue
+		}
+
+		if validID.MatchString(e.Hash) {
+			if _, err := os.Stat(blobPath(e.Hash)); err == nil {
+				continue
+			}
+		}
+
+		data, err := t.ReadFile(e.Path)
+		if err != nil {
+			return err
+		}
+
+		hash := fmt.Sprintf("%x", md5.Sum(data))
+		if hash != e.Hash {
+			Warn("%s changed while building snapshot", e.Path)
+			entries[i].Hash = hash
+			entries[i].Size = int64(len(data))
+		}
+
+		if err := writeAtomic(blobPath(hash), data, 0440); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeSnapshot records the entries of m under its revision.  Snapshots are
+// immutable, so one which already exists is left alone.
+func storeSnapshot(m *manifest.Manifest) error {
+	filename := snapshotPath(m.Revision)
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+
+	snapshot := manifest.New()
+	snapshot.Revision = m.Revision
+	snapshot.Commit = m.Commit
+	snapshot.Generated = m.Generated
+	snapshot.Entries = m.Entries
+
+	var buf bytes.Buffer
+	if err := snapshot.WriteJSON(&buf); err != nil {
+		return err
+	}
+
+	return writeAtomic(filename, buf.Bytes(), 0440)
+}
+
+// loadSnapshot reads the manifest stored for revision.
+func loadSnapshot(revision string) (*manifest.Manifest, error) {
+	if !validID.MatchString(revision) {
+		return nil, fmt.Errorf("Malformed snapshot ID %q", revision)
+	}
+
+	f, err := os.Open(snapshotPath(revision))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return manifest.Parse(f)
+}
+
+// snapshotFile returns where to read filename from.  When the client names
+// the snapshot its manifest came from, or is pinned to one, that is the blob
+// holding the file as of that snapshot.  Otherwise a mapped path is first
+// traced back to its db path, then a client served from git gets the blob
+// from its current commit, and anyone else reads the file itself.
+func (s *session) snapshotFile(filename string) (string, error) {
+	var entries []manifest.Entry
+	name := strings.TrimPrefix(filename, "db/")
+
+	revision := s.Options.Get("snapshot")
+	if revision == "" {
+		revision = s.snapshotPin()
+	}
+
+	if revision != "" {
+		m, err := loadSnapshot(revision)
+		if err != nil {
+			return "", err
+		}
+		entries = m.Entries
+	} else {
+		t, err := s.tree()
+		if err != nil {
+			return "", err
+		}
+		if name == "bin/netskel" {
+			// The client itself lives outside the db
+			return name, servable(name)
+		}
+
+		paths, err := s.pathMap(t)
+		if err != nil {
+			return "", err
+		}
+		if source := paths.source(name); source != name {
+			filename = strings.TrimSuffix(filename, name) + source
+			name = source
+		}
+
+		if _, ok := t.(dirTree); ok {
+			if path.IsAbs(name) {
+				return "", &os.PathError{Op: "open", Path: filename, Err: os.ErrPermission}
+			}
+			filename = filepath.Join(DBDIR, filepath.FromSlash(name))
+			return filename, servable(filename)
+		}
+
+		entries, err = t.Entries()
+		if err != nil {
+			return "", err
+		}
+		for i, e := range entries {
+			if e.Path == name {
+				if err := storeBlobs(t, entries[i:i+1]); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+
+	for _, e := range entries {
+		if e.Path == name && e.Type == manifest.TypeFile {
+			return blobPath(e.Hash), nil
+		}
+	}
+
+	return "", &os.PathError{Op: "snapshot", Path: filename, Err: os.ErrNotExist}
+}
+
+// servable makes sure a file read straight from disk is the client itself
+// or a plain file inside the db, reached without passing through a symlink
+// on the way.
+func servable(filename string) error {
+	clean := filepath.Clean(filename)
+	if clean != "bin/netskel" {
+		rel, err := filepath.Rel(DBDIR, clean)
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+			return &os.PathError{Op: "open", Path: filename, Err: os.ErrPermission}
+		}
+	}
+
+	resolved, err := filepath.EvalSymlinks(clean)
+	if err != nil {
+		return err
+	}
+	if resolved != clean {
+		return &os.PathError{Op: "open", Path: filename, Err: os.ErrPermission}
+	}
+
+	return nil
+}
+
+// snapshotTTL is how long a snapshot no client holds any more is kept, set
+// in days by the snapshot_days server setting.
+func snapshotTTL() time.Duration {
+	days, err := strconv.Atoi(config["snapshot_days"])
+	if err != nil || days < 0 {
+		days = 30
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// heldSnapshots lists the snapshots some client was last sent, was sent
+// before that, or is pinned to.
+func heldSnapshots() (map[string]bool, error) {
+	held := make(map[string]bool)
+
+	db, err := bolt.Open(CLIENTDB, 0660, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(_ []byte, b *bolt.Bucket) error {
+			for _, key := range []string{"revision", "previousRevision", "pin"} {
+				if v := b.Get([]byte(key)); len(v) > 0 {
+					held[string(v)] = true
+				}
+			}
+			return nil
+		})
+	})
+
+	return held, err
+}
+
+// collectGarbage removes the snapshots which no client holds and which are
+// older than the snapshot TTL, then every blob no remaining snapshot refers
+// to.  It runs at most once a day.
+func collectGarbage() error {
+	stamp := filepath.Join(SNAPSHOTDIR, ".gc")
+	if info, err := os.Stat(stamp); err == nil && time.Since(info.ModTime()) < 24*time.Hour {
+		return nil
+	}
+	if err := writeAtomic(stamp, nil, 0640); err != nil {
+		return err
+	}
+
+	held, err := heldSnapshots()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-snapshotTTL())
+	live := make(map[string]bool)
+
+	infos, err := ioutil.ReadDir(SNAPSHOTDIR)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		revision := strings.TrimSuffix(info.Name(), ".json")
+		if revision == info.Name() || !validID.MatchString(revision) {
+			continue
+		}
+
+		if !held[revision] && info.ModTime().Before(cutoff) {
+			Debug("Removing snapshot %s", revision)
+			os.Remove(snapshotPath(revision))
+			continue
+		}
+
+		m, err := loadSnapshot(revision)
+		if err != nil {
+			return err
+		}
+		for _, e := range m.Entries {
+			if e.Type == manifest.TypeFile {
+				live[e.Hash] = true
+			}
+		}
+	}
+
+	// Blobs newer than the cutoff may belong to a snapshot being built
+	return filepath.Walk(BLOBDIR, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if !live[info.Name()] && info.ModTime().Before(cutoff) {
+			Debug("Removing blob %s", info.Name())
+			os.Remove(filename)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	filename := filepath.Join(root, "hello")
+	ioutil.WriteFile(filename, []byte("Hello, world!\n"), 0644)
+
+	m := manifest.New()
+	m.Entries, err = collectDir(root, "")
+	assert.Nil(t, err)
+	fingerprintEntries(root, m.Entries)
+	assert.Nil(t, storeBlobs(dirTree{root}, m.Entries))
+	m.Revision = m.Merkle()
+	assert.Nil(t, storeSnapshot(m))
+
+	// Somebody commits a change after the client fetched its manifest
+	ioutil.WriteFile(filename, []byte("Goodbye, world!\n"), 0644)
+
+	clearStdout()
+	s := newSession()
+	s.Options = url.Values{"snapshot": []string{m.Revision}}
+
+	blob, err := s.snapshotFile("db/hello")
+	assert.Nil(t, err)
+	assert.Nil(t, s.SendRaw(blob))
+	assert.Equal(t, "Hello, world!\n", stdoutBuffer, "Snapshot content was not preserved")
+
+	_, err = s.snapshotFile("db/missing")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSnapshotFileNoSnapshot(t *testing.T) {
+	s := newSession()
+
+	filename, err := s.snapshotFile("db/" + DATAFILE)
+	assert.Nil(t, err)
+	assert.Equal(t, DATAFILE, filename)
+
+	os.Symlink(DATAFILE, "sample.link")
+	defer os.Remove("sample.link")
+
+	_, err = s.snapshotFile("db/sample.link")
+	assert.True(t, os.IsPermission(err), "Served a file through a symlink")
+
+	_, err = s.snapshotFile("db/../../etc/passwd")
+	assert.True(t, os.IsPermission(err), "Served a file outside the db")
+
+	_, err = s.snapshotFile("/etc/passwd")
+	assert.True(t, os.IsPermission(err), "Served a file outside the db")
+}
+
+func TestServable(t *testing.T) {
+	defer func(dir string) { DBDIR = dir }(DBDIR)
+	DBDIR = "db"
+
+	// The server's own databases sit right next to the db
+	for _, filename := range []string{"db/../clients.db", "clients.db", "db", ".ssh/authorized_keys", "snapshots/x.json"} {
+		assert.True(t, os.IsPermission(servable(filename)), "%s is servable", filename)
+	}
+
+	s := newSession()
+	_, err := s.snapshotFile("db/../clients.db")
+	assert.True(t, os.IsPermission(err), "Served a file outside the db")
+}
+
+func TestLoadSnapshotMalformed(t *testing.T) {
+	_, err := loadSnapshot("../../etc/passwd")
+	assert.NotNil(t, err)
+
+	_, err = loadSnapshot("0123456789abcdef")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStoreBlobsCorrectsChangedFile(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	ioutil.WriteFile(filepath.Join(root, "hello"), []byte("Goodbye, world!\n"), 0644)
+
+	entries := []manifest.Entry{{Path: "hello", Type: manifest.TypeFile, Size: 14, Hash: "00000000000000000000000000000000"}}
+	assert.Nil(t, storeBlobs(dirTree{root}, entries))
+	assert.Equal(t, "90cef9cada92ce2cf05cbde9499afbdb", entries[0].Hash)
+	assert.Equal(t, int64(16), entries[0].Size)
+}
+
+func TestNetskelDBPinned(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	saved := DBDIR
+	DBDIR = root
+	defer func() { DBDIR = saved }()
+
+	filename := filepath.Join(root, "hello")
+	ioutil.WriteFile(filename, []byte("Hello, world!\n"), 0644)
+
+	s := newSession()
+	s.UUID = "0b4e6f5c-3b0e-4f38-9d4e-1b7f0b1a2c3d"
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	known, _ := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Equal(t, known.Revision, clientGet(s.UUID, "revision"))
+
+	// netskelctl freeze
+	clientPut(s.UUID, "pin", known.Revision)
+	ioutil.WriteFile(filename, []byte("Goodbye, world!\n"), 0644)
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	pinned, _ := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Equal(t, known.Revision, pinned.Revision, "Pinned client was sent a new revision")
+
+	blob, err := s.snapshotFile("db/hello")
+	assert.Nil(t, err)
+	clearStdout()
+	s.SendRaw(blob)
+	assert.Equal(t, "Hello, world!\n", stdoutBuffer, "Pinned client was sent new content")
+
+	// netskelctl unpin
+	clientPut(s.UUID, "pin", "")
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	current, _ := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.NotEqual(t, known.Revision, current.Revision)
+	assert.Equal(t, known.Revision, clientGet(s.UUID, "previousRevision"))
+}
+
+func TestNetskelDBPinnedRollsBack(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	saved := DBDIR
+	DBDIR = root
+	defer func() { DBDIR = saved }()
+
+	ioutil.WriteFile(filepath.Join(root, "hello"), []byte("Hello, world!\n"), 0644)
+
+	s := newSession()
+	s.UUID = "5e2c8a1f-7d3b-4c9e-a6f0-2b8d4e1c7a93"
+	s.Options = url.Values{"proto": {"2"}}
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	old, _ := manifest.Parse(strings.NewReader(stdoutBuffer))
+
+	ioutil.WriteFile(filepath.Join(root, ".added"), []byte("new\n"), 0644)
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+
+	// netskelctl pin <uuid> previous
+	clientPut(s.UUID, "pin", old.Revision)
+	defer clientPut(s.UUID, "pin", "")
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	pinned, _ := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Equal(t, old.Revision, pinned.Revision)
+
+	var dead []string
+	for _, e := range pinned.Entries {
+		if e.Type == manifest.TypeTombstone {
+			dead = append(dead, e.Path)
+		}
+	}
+	assert.Equal(t, []string{".added"}, dead, "Files added since the pinned snapshot were left on the client")
+
+	// A pin whose snapshot is gone is an error, not a git ref
+	os.Remove(snapshotPath(old.Revision))
+	clearStdout()
+	assert.NotNil(t, s.NetskelDB())
+}
+
+func TestCollectGarbage(t *testing.T) {
+	scratch, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(scratch)
+
+	defer func(blobs, snapshots string) { BLOBDIR, SNAPSHOTDIR = blobs, snapshots }(BLOBDIR, SNAPSHOTDIR)
+	BLOBDIR = filepath.Join(scratch, "blobs")
+	SNAPSHOTDIR = filepath.Join(scratch, "snapshots")
+
+	root := filepath.Join(scratch, "db")
+	os.MkdirAll(root, 0750)
+
+	// Store a snapshot of each version of the file, held by nobody
+	var revisions, hashes []string
+	for _, content := range []string{"Hello, world!\n", "Goodbye, world!\n", "Hello again!\n"} {
+		ioutil.WriteFile(filepath.Join(root, "hello"), []byte(content), 0644)
+
+		m := manifest.New()
+		m.Entries, err = collectDir(root, "")
+		assert.Nil(t, err)
+		fingerprintEntries(root, m.Entries)
+		assert.Nil(t, storeBlobs(dirTree{root}, m.Entries))
+		m.Revision = m.Merkle()
+		assert.Nil(t, storeSnapshot(m))
+
+		revisions = append(revisions, m.Revision)
+		hashes = append(hashes, m.Entries[0].Hash)
+	}
+
+	// The first two are old, and a client still holds the second
+	old := time.Now().Add(-60 * 24 * time.Hour)
+	for i := 0; i < 2; i++ {
+		os.Chtimes(snapshotPath(revisions[i]), old, old)
+		os.Chtimes(blobPath(hashes[i]), old, old)
+	}
+	clientPut("5d1c2b7a-8e4f-4a3b-9c6d-0f1e2a3b4c5d", "revision", revisions[1])
+
+	assert.Nil(t, collectGarbage())
+
+	_, err = os.Stat(snapshotPath(revisions[0]))
+	assert.True(t, os.IsNotExist(err), "Old snapshot was kept")
+	_, err = os.Stat(blobPath(hashes[0]))
+	assert.True(t, os.IsNotExist(err), "Unreferenced blob was kept")
+	for i := 1; i < 3; i++ {
+		_, err = os.Stat(snapshotPath(revisions[i]))
+		assert.Nil(t, err, "Snapshot %d was removed", i)
+		_, err = os.Stat(blobPath(hashes[i]))
+		assert.Nil(t, err, "Blob %d was removed", i)
+	}
+
+	// Once a day is enough
+	os.Chtimes(snapshotPath(revisions[2]), old, old)
+	assert.Nil(t, collectGarbage())
+	_, err = os.Stat(snapshotPath(revisions[2]))
+	assert.Nil(t, err, "Swept twice in a day")
+}
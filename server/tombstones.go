@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// tombstoneTTL is how long a removed file keeps being announced to a client,
+// set in days by the tombstone_days server setting.
+func tombstoneTTL() time.Duration {
+	days, err := strconv.Atoi(config["tombstone_days"])
+	if err != nil || days < 0 {
+		days = 30
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// tombstones compares the entries a client is about to receive with the
+// snapshot it received last, returning a tombstone for every file, symlink
+// and directory which has since disappeared.  Tombstones from that snapshot
+// are carried forward until they expire.
+func (s *session) tombstones(entries []manifest.Entry) []manifest.Entry {
+	var dead []manifest.Entry
+
+	revision := clientGet(s.UUID, "revision")
+	if revision == "" {
+		return dead
+	}
+
+	previous, err := loadSnapshot(revision)
+	if err != nil {
+		Debug("No snapshot %s for %s, skipping tombstones: %v", revision, s.UUID, err)
+		return dead
+	}
+
+	current := make(map[string]bool)
+	for _, e := range entries {
+		current[e.Path] = true
+	}
+
+	now := time.Now()
+	for _, e := range previous.Entries {
+		if current[e.Path] {
+			continue
+		}
+
+		if e.Type == manifest.TypeTombstone {
+			if now.Sub(time.Unix(e.MTime, 0)) < tombstoneTTL() {
+				dead = append(dead, e)
+			}
+			continue
+		}
+
+		// A symlink keeps its target and a directory has no hash, which is
+		// how clients tell them from files
+		e.Type = manifest.TypeTombstone
+		e.MTime = now.Unix()
+		e.Meta = nil
+		dead = append(dead, e)
+	}
+
+	return dead
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTombstones(t *testing.T) {
+	root, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+	defer os.RemoveAll(root)
+
+	saved := DBDIR
+	DBDIR = root
+	defer func() { DBDIR = saved }()
+
+	ioutil.WriteFile(filepath.Join(root, "hello"), []byte("Hello, world!\n"), 0644)
+	ioutil.WriteFile(filepath.Join(root, ".oldrc"), []byte("obsolete\n"), 0644)
+	os.Symlink("hello", filepath.Join(root, ".oldlink"))
+	os.Mkdir(filepath.Join(root, ".olddir"), 0755)
+
+	s := newSession()
+	s.UUID = "7d0b7c1e-1a7e-4c5e-8d58-4f7a5b3c2e10"
+	s.Options = url.Values{"proto": []string{"2"}}
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+
+	os.Remove(filepath.Join(root, ".oldrc"))
+	os.Remove(filepath.Join(root, ".oldlink"))
+	os.Remove(filepath.Join(root, ".olddir"))
+
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err)
+
+	dead := make(map[string]manifest.Entry)
+	for _, e := range m.Entries {
+		if e.Type == manifest.TypeTombstone {
+			dead[e.Path] = e
+		}
+	}
+	assert.Len(t, dead, 3)
+	assert.Equal(t, "b07b61c48f2421670ab99c6422915200", dead[".oldrc"].Hash, "Tombstone must carry the last delivered fingerprint")
+	assert.Equal(t, "hello", dead[".oldlink"].Target, "Symlink tombstone must carry the last delivered target")
+	assert.Empty(t, dead[".oldlink"].Hash)
+	assert.Empty(t, dead[".olddir"].Hash)
+
+	// The tombstone keeps being announced on later syncs
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	assert.Contains(t, stdoutBuffer, ".oldrc\t600\t-\t")
+
+	// but never to the original client, which would try to fetch it
+	s.Options = nil
+	clearStdout()
+	assert.Nil(t, s.NetskelDB())
+	assert.NotContains(t, stdoutBuffer, ".oldrc")
+}
+
+func TestTombstonesExpire(t *testing.T) {
+	s := newSession()
+	s.UUID = "2f1c3b4a-5d6e-4f70-8192-a3b4c5d6e7f8"
+
+	expired := time.Now().Add(-tombstoneTTL() - time.Hour).Unix()
+	m := manifest.New()
+	m.Entries = []manifest.Entry{
+		{Path: ".stale", Type: manifest.TypeTombstone, Hash: "00112233445566778899aabbccddeeff", MTime: expired},
+		{Path: ".fresh", Type: manifest.TypeTombstone, Hash: "00112233445566778899aabbccddeeff", MTime: time.Now().Unix()},
+	}
+	m.Revision = m.Merkle()
+	assert.Nil(t, storeSnapshot(m))
+	clientPut(s.UUID, "revision", m.Revision)
+
+	dead := s.tombstones(nil)
+	assert.Len(t, dead, 1)
+	assert.Equal(t, ".fresh", dead[0].Path)
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/nugget/netskel/manifest"
+)
+
+// A tree is a source of the files served to clients: either the db working
+// tree or a commit in the db git repository.
+type tree interface {
+	// Entries lists every directory and file in the tree, fingerprinted.
+	Entries() ([]manifest.Entry, error)
+
+	// ReadFile returns the content of the named file.
+	ReadFile(name string) ([]byte, error)
+}
+
+// dirTree serves files straight from a directory on disk.
+type dirTree struct {
+	root string
+}
+
+func (d dirTree) Entries() ([]manifest.Entry, error) {
+	entries, err := collectDir(d.root, "")
+	if err != nil {
+		return entries, err
+	}
+
+	entries = ignoreEntries(d, entries)
+	fingerprintEntries(d.root, entries)
+	return entries, nil
+}
+
+func (d dirTree) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(d.root, name))
+}
+
+// gitTree serves files from a commit in a git repository, reading the object
+// database rather than the working tree so uncommitted edits never go live.
+type gitTree struct {
+	dir    string
+	ref    string
+	commit string
+	time   int64
+}
+
+// openGitTree resolves ref in the repository at dir.
+func openGitTree(dir, ref string) (*gitTree, error) {
+	g := &gitTree{dir: dir, ref: ref}
+
+	out, err := g.git(nil, "log", "-1", "--format=%H %ct", ref+"^{commit}", "--")
+	if err != nil {
+		return nil, fmt.Errorf("Unable to resolve %s: %v", ref, err)
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Unable to resolve %s: unexpected output %q", ref, out)
+	}
+	g.commit = fields[0]
+	g.time, _ = strconv.ParseInt(fields[1], 10, 64)
+
+	return g, nil
+}
+
+func (g *gitTree) git(stdin io.Reader, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", append([]string{"-C", g.dir}, args...)...)
+	cmd.Stdin = stdin
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil && stderr.Len() > 0 {
+		err = fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, err
+}
+
+func (g *gitTree) Entries() ([]manifest.Entry, error) {
+	var entries []manifest.Entry
+
+	out, err := g.git(nil, "ls-tree", "-r", "-t", "-l", "-z", g.commit)
+	if err != nil {
+		return entries, err
+	}
+
+	blobs := make(map[string]string)
+
+	for _, record := range strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00") {
+		tab := strings.Index(record, "\t")
+		if tab < 0 {
+			continue
+		}
+		fields := strings.Fields(record[:tab])
+		name := record[tab+1:]
+		if len(fields) != 4 {
+			continue
+		}
+		mode, kind, object := fields[0], fields[1], fields[2]
+
+		switch {
+		case kind == "tree":
+			entries = append(entries, manifest.Entry{Type: manifest.TypeDir, Path: name, Mode: 0755 & modeMask(), MTime: g.time})
+		case kind == "blob" && mode == "120000":
+			target, err := g.ReadFile(name)
+			if err != nil {
+				return entries, err
+			}
+			if !manifest.Contained(name, string(target)) {
+				Warn("Skipping symlink %s -> %s which leaves the db", name, target)
+				continue
+			}
+			entries = append(entries, manifest.Entry{Type: manifest.TypeSymlink, Path: name, Mode: 0777, Size: int64(len(target)), MTime: g.time, Target: string(target)})
+		case kind == "blob" && strings.HasPrefix(mode, "100"):
+			e := manifest.Entry{Type: manifest.TypeFile, Path: name, Mode: 0644 & modeMask(), MTime: g.time}
+			if mode == "100755" {
+				e.Mode = 0755 & modeMask()
+			}
+			e.Size, _ = strconv.ParseInt(fields[3], 10, 64)
+			blobs[name] = object
+			entries = append(entries, e)
+		}
+	}
+
+	entries = ignoreEntries(g, entries)
+
+	objects := make(map[int]string)
+	for i, e := range entries {
+		if object, ok := blobs[e.Path]; ok {
+			objects[i] = object
+		}
+	}
+
+	if err := g.fingerprintObjects(entries, objects); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
+
+// fingerprintObjects fills in the Hash of the entries whose git objects are
+// given.  Git objects never change, so their fingerprints are cached forever.
+func (g *gitTree) fingerprintObjects(entries []manifest.Entry, objects map[int]string) error {
+	keys := make(map[int]string)
+	for i, object := range objects {
+		keys[i] = "git:" + object
+	}
+
+	var misses []string
+	cached := cacheLookup(keys)
+	for i, key := range keys {
+		if value := cached[key]; strings.HasPrefix(value, "blob ") {
+			entries[i].Hash = strings.TrimPrefix(value, "blob ")
+		} else {
+			misses = append(misses, objects[i])
+		}
+	}
+
+	if len(misses) == 0 {
+		return nil
+	}
+
+	hashes, err := g.hashObjects(misses)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]string)
+	for i, object := range objects {
+		if hash, ok := hashes[object]; ok {
+			entries[i].Hash = hash
+			updates["git:"+object] = "blob " + hash
+		}
+	}
+	cacheStore(updates)
+
+	Debug("Fingerprinted %d of %d objects in %s", len(misses), len(objects), g.commit)
+	return nil
+}
+
+// hashObjects streams the given blobs through a single git cat-file and
+// returns the MD5 fingerprint of each.
+func (g *gitTree) hashObjects(objects []string) (map[string]string, error) {
+	hashes := make(map[string]string)
+
+	cmd := exec.Command("git", "-C", g.dir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(strings.Join(objects, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return hashes, err
+	}
+	if err := cmd.Start(); err != nil {
+		return hashes, err
+	}
+	defer cmd.Wait()
+
+	r := bufio.NewReader(stdout)
+	for range objects {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return hashes, err
+		}
+
+		fields := strings.Fields(header)
+		if len(fields) != 3 {
+			return hashes, fmt.Errorf("Unexpected cat-file output %q", header)
+		}
+		size, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return hashes, err
+		}
+
+		hash := md5.New()
+		if _, err := io.CopyN(hash, r, size); err != nil {
+			return hashes, err
+		}
+		r.ReadByte()
+
+		hashes[fields[0]] = fmt.Sprintf("%x", hash.Sum(nil))
+	}
+
+	return hashes, nil
+}
+
+func (g *gitTree) ReadFile(name string) ([]byte, error) {
+	object := g.commit + ":" + name
+
+	if _, err := g.git(nil, "cat-file", "-e", object); err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+
+	return g.git(nil, "cat-file", "blob", object)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nugget/netskel/manifest"
+	"github.com/stretchr/testify/assert"
+)
+
+// gitRepo creates a repository holding one commit of a hello file and a
+// script, then leaves an uncommitted edit to hello in the working tree.
+func gitRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "netskel")
+	assert.Nil(t, err)
+
+	os.Mkdir(filepath.Join(dir, "bin"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("Hello, world!\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "bin/script"), []byte("#!/bin/sh\n"), 0755)
+
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"add", "."},
+		{"-c", "user.name=Netskel", "-c", "user.email=netskel@example.com", "commit", "-q", "-m", "Initial"},
+		{"branch", "-M", "main"},
+	} {
+		out, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+		assert.Nil(t, err, string(out))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "hello"), []byte("Uncommitted\n"), 0644)
+
+	return dir
+}
+
+func TestGitTree(t *testing.T) {
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+
+	g, err := openGitTree(dir, "refs/heads/main")
+	assert.Nil(t, err)
+	assert.Len(t, g.commit, 40)
+
+	entries, err := g.Entries()
+	assert.Nil(t, err)
+
+	byPath := make(map[string]manifest.Entry)
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	assert.Equal(t, manifest.TypeDir, byPath["bin"].Type)
+	assert.Equal(t, uint32(0700), byPath["bin/script"].Mode)
+	assert.Equal(t, uint32(0600), byPath["hello"].Mode)
+	assert.Equal(t, int64(14), byPath["hello"].Size)
+	assert.Equal(t, "746308829575e17c3331bbcb00c0898b", byPath["hello"].Hash, "Served the working tree instead of the commit")
+
+	data, err := g.ReadFile("hello")
+	assert.Nil(t, err)
+	assert.Equal(t, "Hello, world!\n", string(data))
+
+	// The second listing comes from the fingerprint cache
+	again, err := g.Entries()
+	assert.Nil(t, err)
+	assert.Equal(t, entries, again)
+}
+
+func TestGitTreeBadRef(t *testing.T) {
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+
+	_, err := openGitTree(dir, "refs/heads/nonexistent")
+	assert.NotNil(t, err)
+}
+
+func TestNetskelDBFromGit(t *testing.T) {
+	dir := gitRepo(t)
+	defer os.RemoveAll(dir)
+
+	saved := DBDIR
+	DBDIR = dir
+	config["gitref"] = "main"
+	defer func() {
+		DBDIR = saved
+		delete(config, "gitref")
+	}()
+
+	clearStdout()
+	s := newSession()
+	assert.Nil(t, s.NetskelDB())
+
+	m, err := manifest.Parse(strings.NewReader(stdoutBuffer))
+	assert.Nil(t, err)
+	assert.Len(t, m.Commit, 40, "Manifest did not carry the commit ID")
+
+	clearStdout()
+	filename, err := s.snapshotFile("db/hello")
+	assert.Nil(t, err)
+	assert.Nil(t, s.SendRaw(filename))
+	assert.Equal(t, "Hello, world!\n", stdoutBuffer)
+
+	s.Options = url.Values{"snapshot": []string{m.Revision}}
+	filename, err = s.snapshotFile("db/hello")
+	assert.Nil(t, err)
+	clearStdout()
+	assert.Nil(t, s.SendRaw(filename))
+	assert.Equal(t, "Hello, world!\n", stdoutBuffer)
+}